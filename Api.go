@@ -2,11 +2,14 @@ package main
 
 import (
 	"net/http"
+	"strconv"
 )
 
 type CApi struct {
 	conversation IConversationTracker
 	provider     IPacketProvider
+	dispatcher   *CEventDispatcher
+	matcher      IRuleMatcher
 }
 
 //---------------------------------------------------------------------------------------
@@ -19,17 +22,156 @@ func (thisPt *CApi) dumpConversations(w http.ResponseWriter, req *http.Request)
 	w.Write([]byte(thisPt.conversation.Dump()))
 }
 
+//---------------------------------------------------------------------------------------
+func (thisPt *CApi) dumpTopConversations(w http.ResponseWriter, req *http.Request) {
+	count, _ := strconv.Atoi(req.URL.Query().Get("count"))
+	w.Write([]byte(thisPt.conversation.DumpTop(count)))
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CApi) dumpConversationsStat(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(thisPt.conversation.DumpStat()))
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CApi) dumpEvents(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(thisPt.dispatcher.Dump()))
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CApi) dumpPools(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(thisPt.matcher.DumpPools()))
+}
+
+//---------------------------------------------------------------------------------------
+//add data to a pool, for example /pools/topup?name=family&size=1gb
+func (thisPt *CApi) topUpPool(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	if err := thisPt.matcher.TopUpPool(query.Get("name"), query.Get("size")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte(thisPt.matcher.DumpPools()))
+}
+
+//---------------------------------------------------------------------------------------
+//clear the usage and the top ups of a pool, for example /pools/reset?name=family
+func (thisPt *CApi) resetPool(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := thisPt.matcher.ResetPool(req.URL.Query().Get("name")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte(thisPt.matcher.DumpPools()))
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CApi) dumpRulesStatus(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(thisPt.matcher.DumpReloadStatus()))
+}
+
+//---------------------------------------------------------------------------------------
+//the active rules in the format of the rules file
+func (thisPt *CApi) dumpRules(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(thisPt.matcher.DumpRules()))
+}
+
+//---------------------------------------------------------------------------------------
+//reload the rules. the current rules stay active on any error
+func (thisPt *CApi) reloadRules(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := thisPt.matcher.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte(thisPt.matcher.DumpReloadStatus()))
+}
+
+//---------------------------------------------------------------------------------------
+//the kept versions of the rules
+func (thisPt *CApi) dumpRuleVersions(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(thisPt.matcher.DumpRuleVersions()))
+}
+
+//---------------------------------------------------------------------------------------
+//difference of two versions, for example /rules/diff?from=3&to=5. to is the active version by default
+func (thisPt *CApi) diffRuleVersions(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	from, err := strconv.ParseUint(query.Get("from"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid from", http.StatusBadRequest)
+		return
+	}
+	to := uint64(0)
+	if len(query.Get("to")) > 0 {
+		if to, err = strconv.ParseUint(query.Get("to"), 10, 64); err != nil {
+			http.Error(w, "invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	diff, err := thisPt.matcher.DiffRuleVersions(from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Write([]byte(diff))
+}
+
+//---------------------------------------------------------------------------------------
+//activate and pin a kept version of the rules, for example /rules/activate?generation=3. generation=0 activates the
+//rules of the repository again
+func (thisPt *CApi) activateRuleVersion(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	generation, err := strconv.ParseUint(req.URL.Query().Get("generation"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid generation", http.StatusBadRequest)
+		return
+	}
+	if err := thisPt.matcher.ActivateRuleVersion(generation); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write([]byte(thisPt.matcher.DumpRuleVersions()))
+}
+
 //---------------------------------------------------------------------------------------
 func (thisPt *CApi) serve() {
 	http.HandleFunc("/conversations", thisPt.dumpConversations)
+	http.HandleFunc("/conversations/stat", thisPt.dumpConversationsStat)
+	http.HandleFunc("/conversations/top", thisPt.dumpTopConversations)
 	http.HandleFunc("/provider", thisPt.dumpProvider)
+	http.HandleFunc("/events", thisPt.dumpEvents)
+	http.HandleFunc("/pools", thisPt.dumpPools)
+	http.HandleFunc("/pools/topup", thisPt.topUpPool)
+	http.HandleFunc("/pools/reset", thisPt.resetPool)
+	http.HandleFunc("/rules", thisPt.dumpRules)
+	http.HandleFunc("/rules/status", thisPt.dumpRulesStatus)
+	http.HandleFunc("/rules/reload", thisPt.reloadRules)
+	http.HandleFunc("/rules/versions", thisPt.dumpRuleVersions)
+	http.HandleFunc("/rules/diff", thisPt.diffRuleVersions)
+	http.HandleFunc("/rules/activate", thisPt.activateRuleVersion)
 	http.ListenAndServe("127.0.0.1:8080", nil)
 }
 
 //---------------------------------------------------------------------------------------
-func CreateApiServer(conv IConversationTracker, provider IPacketProvider) {
+func CreateApiServer(conv IConversationTracker, provider IPacketProvider, dispatcher *CEventDispatcher, matcher IRuleMatcher) {
 	api := CApi{}
+	api.matcher = matcher
 	api.conversation = conv
 	api.provider = provider
+	api.dispatcher = dispatcher
 	go api.serve()
 }
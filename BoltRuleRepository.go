@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.etcd.io/bbolt"
+)
+
+//buckets of the rules database. the items are kept as json by their names
+var (
+	boltRulesBucket  = []byte("rules")
+	boltGroupsBucket = []byte("groups")
+	boltPoolsBucket  = []byte("pools")
+	boltExemptBucket = []byte("exempt_networks")
+	boltBuckets      = [][]byte{boltRulesBucket, boltGroupsBucket, boltPoolsBucket, boltExemptBucket}
+)
+
+//wait for the other processes writing the database
+const BoltOpenTimeout = 5 * time.Second
+
+//---------------------------------------------------------------------------------------
+//rules repository kept in a bbolt database. the database is just opened during the reads and the writes, so
+//the provisioning tools can update it while the firewall is running. the changes are reported to the channel
+type CBoltRuleRepository struct {
+	fileName  string
+	lock      sync.RWMutex
+	rules     *CJsonRuleRepository
+	changes   chan struct{}
+	watcher   *fsnotify.Watcher
+	watchLock sync.Mutex
+	timer     *time.Timer
+	modTime   time.Time
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) openDB(readOnly bool) (*bbolt.DB, error) {
+	return bbolt.Open(thisPt.fileName, 0600, &bbolt.Options{Timeout: BoltOpenTimeout, ReadOnly: readOnly})
+}
+
+//---------------------------------------------------------------------------------------
+//report the change without blocking. the pending changes are merged
+func (thisPt *CBoltRuleRepository) notify() {
+	select {
+	case thisPt.changes <- struct{}{}:
+	default:
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//keep the modification time of the database. the file events are reported just if the database is modified again
+func (thisPt *CBoltRuleRepository) isModified() bool {
+	info, err := os.Stat(thisPt.fileName)
+	if err != nil {
+		return true
+	}
+
+	thisPt.watchLock.Lock()
+	defer thisPt.watchLock.Unlock()
+	if info.ModTime().Equal(thisPt.modTime) {
+		return false
+	}
+	thisPt.modTime = info.ModTime()
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+//run the function in a write transaction and report the change
+func (thisPt *CBoltRuleRepository) update(fn func(tx *bbolt.Tx) error) error {
+	db, err := thisPt.openDB(false)
+	if err != nil {
+		return err
+	}
+	err = db.Update(fn)
+	db.Close()
+
+	//the file events of this write are not reported again
+	thisPt.isModified()
+	if err != nil {
+		return err
+	}
+	thisPt.notify()
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) onFileChange() {
+	thisPt.watchLock.Lock()
+	defer thisPt.watchLock.Unlock()
+
+	//several events are reported for a single write
+	if thisPt.timer != nil {
+		thisPt.timer.Stop()
+	}
+	thisPt.timer = time.AfterFunc(RuleWatchDelay, func() {
+		if thisPt.isModified() {
+			thisPt.notify()
+		}
+	})
+}
+
+//---------------------------------------------------------------------------------------
+//watch the directory of the database, the provisioning tools could replace the file
+func (thisPt *CBoltRuleRepository) watch(watcher *fsnotify.Watcher, fileName string) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 && filepath.Clean(event.Name) == fileName {
+				thisPt.onFileChange()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("rules database watcher error, %v \n", err)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) startWatch() error {
+	fileName, err := filepath.Abs(thisPt.fileName)
+	if err != nil {
+		return err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(fileName)); err != nil {
+		watcher.Close()
+		return err
+	}
+	thisPt.watcher = watcher
+	go thisPt.watch(watcher, fileName)
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+func putBoltItem(tx *bbolt.Tx, bucket []byte, name string, item interface{}) error {
+	if len(name) == 0 {
+		return errors.New("empty name")
+	}
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucket).Put([]byte(name), data)
+}
+
+//---------------------------------------------------------------------------------------
+func deleteBoltItem(tx *bbolt.Tx, bucket []byte, name string) error {
+	if tx.Bucket(bucket).Get([]byte(name)) == nil {
+		return fmt.Errorf("%s %s not found", bucket, name)
+	}
+	return tx.Bucket(bucket).Delete([]byte(name))
+}
+
+//---------------------------------------------------------------------------------------
+//decode all the items of the bucket, the items are sorted by name
+func readBoltItems(tx *bbolt.Tx, bucket []byte, decode func(data []byte) error) error {
+	return tx.Bucket(bucket).ForEach(func(key []byte, data []byte) error {
+		if err := decode(data); err != nil {
+			return fmt.Errorf("invalid %s %s, %v", bucket, key, err)
+		}
+		return nil
+	})
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) loadRules() error {
+	db, err := thisPt.openDB(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	rules := []SRule{}
+	groups := []SGroup{}
+	pools := []SPool{}
+	exempt := []string{}
+	err = db.View(func(tx *bbolt.Tx) error {
+		for _, bucket := range boltBuckets {
+			if tx.Bucket(bucket) == nil {
+				return fmt.Errorf("bucket %s not found", bucket)
+			}
+		}
+		if err := readBoltItems(tx, boltRulesBucket, func(data []byte) error {
+			rule := SRule{}
+			err := json.Unmarshal(data, &rule)
+			rule.Origin = thisPt.fileName
+			rules = append(rules, rule)
+			return err
+		}); err != nil {
+			return err
+		}
+		if err := readBoltItems(tx, boltGroupsBucket, func(data []byte) error {
+			group := SGroup{}
+			err := json.Unmarshal(data, &group)
+			groups = append(groups, group)
+			return err
+		}); err != nil {
+			return err
+		}
+		if err := readBoltItems(tx, boltPoolsBucket, func(data []byte) error {
+			pool := SPool{}
+			err := json.Unmarshal(data, &pool)
+			pools = append(pools, pool)
+			return err
+		}); err != nil {
+			return err
+		}
+		return readBoltItems(tx, boltExemptBucket, func(data []byte) error {
+			network := ""
+			err := json.Unmarshal(data, &network)
+			exempt = append(exempt, network)
+			return err
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	thisPt.lock.Lock()
+	thisPt.rules = &CJsonRuleRepository{Rules: rules, Groups: groups, Pools: pools, Exempt: exempt}
+	thisPt.lock.Unlock()
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+//the channel is notified when the database is changed
+func (thisPt *CBoltRuleRepository) Changes() <-chan struct{} {
+	return thisPt.changes
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) PutRule(rule SRule) error {
+	return thisPt.update(func(tx *bbolt.Tx) error {
+		return putBoltItem(tx, boltRulesBucket, rule.Name, rule)
+	})
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) DeleteRule(name string) error {
+	return thisPt.update(func(tx *bbolt.Tx) error {
+		return deleteBoltItem(tx, boltRulesBucket, name)
+	})
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) PutGroup(group SGroup) error {
+	return thisPt.update(func(tx *bbolt.Tx) error {
+		return putBoltItem(tx, boltGroupsBucket, group.Name, group)
+	})
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) DeleteGroup(name string) error {
+	return thisPt.update(func(tx *bbolt.Tx) error {
+		return deleteBoltItem(tx, boltGroupsBucket, name)
+	})
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) PutPool(pool SPool) error {
+	return thisPt.update(func(tx *bbolt.Tx) error {
+		return putBoltItem(tx, boltPoolsBucket, pool.Name, pool)
+	})
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) DeletePool(name string) error {
+	return thisPt.update(func(tx *bbolt.Tx) error {
+		return deleteBoltItem(tx, boltPoolsBucket, name)
+	})
+}
+
+//---------------------------------------------------------------------------------------
+//replace the content of the database with the rules of another repository, used to migrate the json rules
+func (thisPt *CBoltRuleRepository) Import(source IRuleRepository) error {
+	snapshot := source.GetSnapshot()
+	return thisPt.update(func(tx *bbolt.Tx) error {
+		for _, bucket := range boltBuckets {
+			if err := tx.DeleteBucket(bucket); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(bucket); err != nil {
+				return err
+			}
+		}
+
+		//the items are kept by name, so the names must be unique
+		for _, rule := range snapshot.Rules {
+			if tx.Bucket(boltRulesBucket).Get([]byte(rule.Name)) != nil {
+				return newRuleError(rule.Name, "name", "duplicate rule name")
+			}
+			if err := putBoltItem(tx, boltRulesBucket, rule.Name, rule); err != nil {
+				return newRuleError(rule.Name, "name", err.Error())
+			}
+		}
+		for _, group := range snapshot.Groups {
+			if err := putBoltItem(tx, boltGroupsBucket, group.Name, group); err != nil {
+				return newRuleError("", "groups", err.Error())
+			}
+		}
+		for _, pool := range snapshot.Pools {
+			if err := putBoltItem(tx, boltPoolsBucket, pool.Name, pool); err != nil {
+				return newRuleError("", "pools", err.Error())
+			}
+		}
+		for _, network := range snapshot.Exempt {
+			if err := putBoltItem(tx, boltExemptBucket, network, network); err != nil {
+				return newRuleError("", "exempt_networks", err.Error())
+			}
+		}
+		return nil
+	})
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CBoltRuleRepository) Close() {
+	if thisPt.watcher != nil {
+		thisPt.watcher.Close()
+	}
+	thisPt.watchLock.Lock()
+	if thisPt.timer != nil {
+		thisPt.timer.Stop()
+	}
+	thisPt.watchLock.Unlock()
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetSnapshot
+//the rules of the last load, the loads replace the snapshot
+func (thisPt *CBoltRuleRepository) GetSnapshot() *CJsonRuleRepository {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+	return thisPt.rules
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetRules
+func (thisPt *CBoltRuleRepository) GetRules() []SRule {
+	return thisPt.GetSnapshot().Rules
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetGroups
+func (thisPt *CBoltRuleRepository) GetGroups() []SGroup {
+	return thisPt.GetSnapshot().Groups
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetExemptNetworks
+func (thisPt *CBoltRuleRepository) GetExemptNetworks() []string {
+	return thisPt.GetSnapshot().Exempt
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetPools
+func (thisPt *CBoltRuleRepository) GetPools() []SPool {
+	return thisPt.GetSnapshot().Pools
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.Reload
+func (thisPt *CBoltRuleRepository) Reload() error {
+	return thisPt.loadRules()
+}
+
+//---------------------------------------------------------------------------------------
+//open the rules database, the database and its buckets are created if they do not exist. the changes of the
+//other processes are detected by watching the file
+func CreateBoltRuleRepository(fileName string) (*CBoltRuleRepository, error) {
+	ruleRep := new(CBoltRuleRepository)
+	ruleRep.fileName = fileName
+	ruleRep.changes = make(chan struct{}, 1)
+
+	db, err := ruleRep.openDB(false)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ruleRep.loadRules(); err != nil {
+		return nil, err
+	}
+
+	ruleRep.isModified()
+	if err := ruleRep.startWatch(); err != nil {
+		log.Printf("can not watch the rules database, %v \n", err)
+	}
+	return ruleRep, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitRuleChange(t *testing.T, repos *CBoltRuleRepository) {
+	select {
+	case <-repos.Changes():
+	case <-time.After(5 * time.Second):
+		t.Fatal("change is not reported")
+	}
+}
+
+func TestBoltRuleRepository(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rules.db")
+	repos, err := CreateBoltRuleRepository(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	if len(repos.GetRules()) != 0 {
+		t.Fatal("new database should be empty")
+	}
+
+	//migrate the json rules
+	jsonRules, err := CreateJsonRuleRepositoryFromStr(`
+	{
+		"groups":[{"name":"kids","members":["10.20.5.0/24"]}],
+		"pools":[{"name":"family","size":"10kb"}],
+		"exempt_networks":["10.0.0.1/32"],
+		"rules":[
+			{"name":"kids","sources":["kids"],"destination":"0.0.0.0/0","pool":"family","protocol":"any"},
+			{"name":"default","destination":"0.0.0.0/0","usage_size":"1kb","protocol":"any"}
+		]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Import(jsonRules); err != nil {
+		t.Fatal(err)
+	}
+	waitRuleChange(t, repos)
+	if err := repos.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(repos.GetRules()) != 2 || len(repos.GetGroups()) != 1 || len(repos.GetPools()) != 1 || len(repos.GetExemptNetworks()) != 1 {
+		t.Fatal("rules are not imported")
+	}
+	if repos.GetRules()[1].Pool != "family" || repos.GetGroups()[0].Members[0] != "10.20.5.0/24" {
+		t.Fatal("invalid imported rules")
+	}
+
+	//the changes drive the matcher
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher, err := CreateMatcher(repos, conv, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matcher.Close()
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("10.5.0.1").To4()
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_TCP
+	packet.DataSize = 100
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "default" {
+		t.Fatal("match failed")
+	}
+
+	if err := repos.PutRule(SRule{Name: "office", Destination: "10.5.0.0/16", UsageSize: "1mb", L4Protocol: "any"}); err != nil {
+		t.Fatal(err)
+	}
+	waitRuleChange(t, repos)
+
+	//the own writes are reported once, the file watcher ignores them
+	select {
+	case <-repos.Changes():
+		t.Fatal("own write is reported twice")
+	case <-time.After(3 * RuleWatchDelay):
+	}
+	if err := matcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "office" {
+		t.Fatal("new rule is not loaded")
+	}
+
+	//the writes of the other processes are detected by the file watcher
+	other, err := CreateBoltRuleRepository(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	if err := other.DeleteRule("office"); err != nil {
+		t.Fatal(err)
+	}
+	waitRuleChange(t, repos)
+	if err := matcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "default" {
+		t.Fatal("deleted rule is still used")
+	}
+
+	if repos.DeleteRule("unknown") == nil || repos.PutGroup(SGroup{}) == nil {
+		t.Fatal("invalid changes should be rejected")
+	}
+
+	//the names are the keys of the rules
+	jsonRules, _ = CreateJsonRuleRepositoryFromStr(`{"rules":[{"name":"x","destination":"10.0.0.0/8"},{"name":"x","destination":"10.1.0.0/16"}]}`)
+	if err := repos.Import(jsonRules); err == nil {
+		t.Fatal("duplicate rule names should be rejected")
+	}
+	if err := repos.Reload(); err != nil || len(repos.GetRules()) != 2 {
+		t.Fatal("failed import should not change the database")
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sync"
+)
+
+//---------------------------------------------------------------------------------------
+//merge several rule repositories. the children are merged in their order, the rules, groups and pools of the later
+//children replace the ones with the same name of the earlier children in place. the exempt networks are merged
+type CCompositeRuleRepository struct {
+	children []IRuleRepository
+	lock     sync.RWMutex
+	merged   *CJsonRuleRepository
+}
+
+//---------------------------------------------------------------------------------------
+//the items without name are never replaced
+func mergeRuleRepositories(children []IRuleRepository) *CJsonRuleRepository {
+	merged := new(CJsonRuleRepository)
+	rules := map[string]int{}
+	groups := map[string]int{}
+	pools := map[string]int{}
+	exempt := map[string]bool{}
+
+	for _, child := range children {
+		//one snapshot of each child, a reload of the child does not mix its rules
+		snapshot := child.GetSnapshot()
+		for _, rule := range snapshot.Rules {
+			if i, fnd := rules[rule.Name]; fnd && len(rule.Name) > 0 {
+				merged.Rules[i] = rule
+				continue
+			}
+			rules[rule.Name] = len(merged.Rules)
+			merged.Rules = append(merged.Rules, rule)
+		}
+		for _, group := range snapshot.Groups {
+			if i, fnd := groups[group.Name]; fnd && len(group.Name) > 0 {
+				merged.Groups[i] = group
+				continue
+			}
+			groups[group.Name] = len(merged.Groups)
+			merged.Groups = append(merged.Groups, group)
+		}
+		for _, pool := range snapshot.Pools {
+			if i, fnd := pools[pool.Name]; fnd && len(pool.Name) > 0 {
+				merged.Pools[i] = pool
+				continue
+			}
+			pools[pool.Name] = len(merged.Pools)
+			merged.Pools = append(merged.Pools, pool)
+		}
+		for _, network := range snapshot.Exempt {
+			if !exempt[network] {
+				exempt[network] = true
+				merged.Exempt = append(merged.Exempt, network)
+			}
+		}
+	}
+	return merged
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetSnapshot
+func (thisPt *CCompositeRuleRepository) GetSnapshot() *CJsonRuleRepository {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+	return thisPt.merged
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetRules
+func (thisPt *CCompositeRuleRepository) GetRules() []SRule {
+	return thisPt.GetSnapshot().Rules
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetGroups
+func (thisPt *CCompositeRuleRepository) GetGroups() []SGroup {
+	return thisPt.GetSnapshot().Groups
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetExemptNetworks
+func (thisPt *CCompositeRuleRepository) GetExemptNetworks() []string {
+	return thisPt.GetSnapshot().Exempt
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetPools
+func (thisPt *CCompositeRuleRepository) GetPools() []SPool {
+	return thisPt.GetSnapshot().Pools
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.Reload
+func (thisPt *CCompositeRuleRepository) Reload() error {
+	//the rules are not changed if any child fails
+	for _, child := range thisPt.children {
+		if err := child.Reload(); err != nil {
+			return err
+		}
+	}
+
+	merged := mergeRuleRepositories(thisPt.children)
+	thisPt.lock.Lock()
+	thisPt.merged = merged
+	thisPt.lock.Unlock()
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+//the children are merged in their order, the later ones override the earlier ones
+func CreateCompositeRuleRepository(children ...IRuleRepository) *CCompositeRuleRepository {
+	ruleRep := new(CCompositeRuleRepository)
+	ruleRep.children = children
+	ruleRep.merged = mergeRuleRepositories(children)
+	return ruleRep
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompositeRuleRep(t *testing.T) {
+	base, err := CreateJsonRuleRepositoryFromStr(`
+	{
+		"rules":[
+			{"name":"web","destination":"10.1.0.0/16","protocol":"any"},
+			{"name":"mail","destination":"10.2.0.0/16","protocol":"any"}
+		],
+		"groups":[{"name":"kids","members":["192.168.1.0/24"]}],
+		"exempt_networks":["10.9.0.0/16"]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	customer, err := CreateJsonRuleRepositoryFromStr(`
+	{
+		"rules":[
+			{"name":"mail","destination":"10.3.0.0/16","protocol":"any"},
+			{"name":"dns","destination":"10.4.0.0/16","protocol":"udp"}
+		],
+		"groups":[{"name":"kids","members":["192.168.2.0/24"]}],
+		"exempt_networks":["10.9.0.0/16","10.8.0.0/16"]
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//the later repositories override the rules in place
+	composite := CreateCompositeRuleRepository(base, customer)
+	rules := composite.GetRules()
+	if len(rules) != 3 || rules[0].Name != "web" || rules[1].Destination != "10.3.0.0/16" || rules[2].Name != "dns" {
+		t.Fatalf("invalid rules %+v", rules)
+	}
+	if len(composite.GetGroups()) != 1 || composite.GetGroups()[0].Members[0] != "192.168.2.0/24" {
+		t.Fatalf("invalid groups %+v", composite.GetGroups())
+	}
+	if len(composite.GetExemptNetworks()) != 2 {
+		t.Fatalf("invalid exempt networks %v", composite.GetExemptNetworks())
+	}
+
+	//the order defines the override
+	reversed := CreateCompositeRuleRepository(customer, base)
+	if reversed.GetRules()[0].Destination != "10.2.0.0/16" || reversed.GetGroups()[0].Members[0] != "192.168.1.0/24" {
+		t.Fatalf("invalid rules %+v", reversed.GetRules())
+	}
+
+	matcher, err := CreateMatcher(composite, nil, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher.Close()
+	if err := composite.Reload(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompositeRuleRepOrigin(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(fileName, []byte(`{"rules":[{"name":"local","destination":"10.0.0.0/8","protocol":"any"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	local, err := CreateJsonRuleRepository(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbName := filepath.Join(dir, "rules.db")
+	central, err := CreateBoltRuleRepository(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer central.Close()
+	if err := central.PutRule(SRule{Name: "central", Destination: "10.0.0.0/8", L4Protocol: "any"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := central.Reload(); err != nil || central.GetRules()[0].Origin != dbName {
+		t.Fatalf("invalid origin of the database rules %+v", central.GetRules())
+	}
+
+	//the duplicate error reports the origins of both rules
+	_, err = CreateMatcher(CreateCompositeRuleRepository(central, local), nil, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil)
+	ruleErr := new(SRuleError)
+	if !errors.As(err, &ruleErr) || ruleErr.Origin != fileName || !strings.Contains(ruleErr.Reason, dbName) {
+		t.Fatalf("invalid duplicate error %v", err)
+	}
+}
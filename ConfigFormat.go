@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+//---------------------------------------------------------------------------------------
+//detect the format by the extension of the file. files without any known extension are detected by the content,
+//json starts with {, then toml is tried and finally yaml. empty files are json
+func detectConfigFormat(fileName string, data []byte) int {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		return ConfigFormatJson
+	case ".yaml", ".yml":
+		return ConfigFormatYaml
+	case ".toml":
+		return ConfigFormatToml
+	}
+
+	if len(data) == 0 || bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return ConfigFormatJson
+	}
+	item := map[string]interface{}{}
+	if _, err := toml.Decode(string(data), &item); err == nil {
+		return ConfigFormatToml
+	}
+	return ConfigFormatYaml
+}
+
+//---------------------------------------------------------------------------------------
+//the decoders return float64 for the json numbers, keep the integers as integers. the arrays of objects are
+//converted to arrays of tables for toml
+func normalizeConfigValue(value interface{}) interface{} {
+	switch item := value.(type) {
+	case float64:
+		if item == math.Trunc(item) && math.Abs(item) < 1<<53 {
+			return int64(item)
+		}
+	case map[string]interface{}:
+		for key, child := range item {
+			if child == nil {
+				//toml does not have null
+				delete(item, key)
+				continue
+			}
+			item[key] = normalizeConfigValue(child)
+		}
+	case []interface{}:
+		tables := []map[string]interface{}{}
+		for i, child := range item {
+			item[i] = normalizeConfigValue(child)
+			if table, ok := item[i].(map[string]interface{}); ok {
+				tables = append(tables, table)
+			}
+		}
+		if len(tables) > 0 && len(tables) == len(item) {
+			return tables
+		}
+	}
+	return value
+}
+
+//---------------------------------------------------------------------------------------
+//convert yaml or toml to json. all the formats have the same schema, the json names of the fields
+func decodeConfig(data []byte, format int) ([]byte, error) {
+	if format == ConfigFormatJson {
+		return data, nil
+	}
+
+	item := map[string]interface{}{}
+	if format == ConfigFormatToml {
+		if _, err := toml.Decode(string(data), &item); err != nil {
+			return nil, err
+		}
+	} else if err := yaml.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+
+	out, err := json.Marshal(item)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s file, %v", GetConfigFormatName(format), err)
+	}
+	return out, nil
+}
+
+//---------------------------------------------------------------------------------------
+//convert json to the format
+func encodeConfig(data []byte, format int) ([]byte, error) {
+	item := map[string]interface{}{}
+	if err := json.Unmarshal(data, &item); err != nil {
+		return nil, err
+	}
+	normalizeConfigValue(item)
+
+	switch format {
+	case ConfigFormatYaml:
+		return yaml.Marshal(item)
+	case ConfigFormatToml:
+		buf := new(bytes.Buffer)
+		if err := toml.NewEncoder(buf).Encode(item); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return json.MarshalIndent(item, "", "    ")
+}
+
+//---------------------------------------------------------------------------------------
+//read a settings or rules file in any format and return it as json
+func readConfigFile(fileName string) ([]byte, error) {
+	stat, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() > MAX_FILE_SIZE {
+		return nil, fmt.Errorf("file %s is too big", fileName)
+	}
+
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return decodeConfig(data, detectConfigFormat(fileName, data))
+}
+
+//---------------------------------------------------------------------------------------
+//convert the configuration files between the formats, used by the convert subcommand.
+//convert [-to json|yaml|toml] input [output]
+func runConvertCommand(args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	to := flags.String("to", "", "output format, json, yaml or toml. default is the extension of the output file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return errors.New("usage: convert [-to json|yaml|toml] input [output]")
+	}
+
+	output := flags.Arg(1)
+	format := GetConfigFormatNumber(strings.ToLower(*to))
+	if len(*to) > 0 && GetConfigFormatName(format) != strings.ToLower(*to) && strings.ToLower(*to) != "yml" {
+		return fmt.Errorf("invalid format %s", *to)
+	}
+	if len(*to) == 0 && len(output) > 0 {
+		format = detectConfigFormat(output, nil)
+	}
+
+	data, err := readConfigFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	data, err = encodeConfig(data, format)
+	if err != nil {
+		return err
+	}
+
+	if len(output) == 0 {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(output, data, 0644)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigFormats(t *testing.T) {
+	jsonSettings, err := LoadSettings("settings/setting.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonRules, err := CreateJsonRuleRepository("settings/setting.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withoutOrigin := func(rules []SRule) []SRule {
+		items := make([]SRule, len(rules))
+		for i, rule := range rules {
+			rule.Origin = ""
+			items[i] = rule
+		}
+		return items
+	}
+	checkFile := func(fileName string) {
+		settings, err := LoadSettings(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(settings, jsonSettings) {
+			t.Fatalf("invalid settings of %s, %+v", fileName, settings)
+		}
+		rules, err := CreateJsonRuleRepository(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//the origins are the file names
+		if !reflect.DeepEqual(withoutOrigin(rules.GetRules()), withoutOrigin(jsonRules.GetRules())) {
+			t.Fatalf("invalid rules of %s, %+v", fileName, rules.GetRules())
+		}
+	}
+	checkFile("settings/setting.yaml")
+
+	//convert to all the formats, with and without the extensions
+	dir := t.TempDir()
+	for _, item := range []struct {
+		args   []string
+		output string
+		format int
+	}{
+		{[]string{"settings/setting.json", filepath.Join(dir, "setting.toml")}, "setting.toml", ConfigFormatToml},
+		{[]string{"settings/setting.yaml", filepath.Join(dir, "setting.yml")}, "setting.yml", ConfigFormatYaml},
+		{[]string{"-to", "toml", "settings/setting.yaml", filepath.Join(dir, "setting-toml")}, "setting-toml", ConfigFormatToml},
+		{[]string{"-to", "yaml", "settings/setting.json", filepath.Join(dir, "setting-yaml")}, "setting-yaml", ConfigFormatYaml},
+		{[]string{filepath.Join(dir, "setting.toml"), filepath.Join(dir, "setting.json")}, "setting.json", ConfigFormatJson},
+	} {
+		if err := runConvertCommand(item.args); err != nil {
+			t.Fatal(err)
+		}
+		fileName := filepath.Join(dir, item.output)
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if format := detectConfigFormat("", data); format != item.format {
+			t.Fatalf("invalid format %s of %s", GetConfigFormatName(format), item.output)
+		}
+		checkFile(fileName)
+	}
+
+	if runConvertCommand([]string{"-to", "xml", "settings/setting.json"}) == nil || runConvertCommand([]string{}) == nil {
+		t.Fatal("invalid arguments should be rejected")
+	}
+	if _, err := decodeConfig([]byte("rules: [\n"), ConfigFormatYaml); err == nil {
+		t.Fatal("invalid yaml should be rejected")
+	}
+	if _, err := decodeConfig([]byte("rules = \n"), ConfigFormatToml); err == nil {
+		t.Fatal("invalid toml should be rejected")
+	}
+}
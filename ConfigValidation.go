@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//limits of the settings. the conversations are kept in HashBucketSize buckets, larger tables make the bucket
+//lists too long
+const (
+	MaxConversationsPerBucket       = 64
+	MaxInactiveConversationLifeTime = 30 * 24 * 3600 //second
+	MaxEventQueueSize               = 1 << 20
+	MaxRulesHistorySize             = 1000
+	MaxActiveTimeSlice              = 3600 //second
+)
+
+//---------------------------------------------------------------------------------------
+//all the fields of a configuration file. the settings file has the rules too. $schema is used by the editors
+type sConfigFile struct {
+	Schema string `json:"$schema"`
+	SSettings
+	CJsonRuleRepository
+}
+
+//---------------------------------------------------------------------------------------
+//just the first error of a field is kept, the other errors of the field are usually caused by the first one
+func (thisPt *SConfigErrors) add(path string, format string, args ...interface{}) {
+	for _, item := range *thisPt {
+		if item.Path == path {
+			return
+		}
+	}
+	*thisPt = append(*thisPt, &SConfigError{Path: path, Reason: fmt.Sprintf(format, args...)})
+}
+
+//---------------------------------------------------------------------------------------
+func joinConfigPath(path string, field string) string {
+	if len(path) == 0 {
+		return field
+	}
+	return path + "." + field
+}
+
+//---------------------------------------------------------------------------------------
+//map the json names to the fields of the struct, the fields of the embedded structs are included
+func getConfigFields(typ reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			getConfigFields(field.Type, fields)
+			continue
+		}
+		if len(field.PkgPath) > 0 {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if len(name) == 0 {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//check the decoded json against the type. unknown fields and invalid types are reported with their paths
+func checkConfigFields(value interface{}, typ reflect.Type, path string, errs *SConfigErrors) {
+	if value == nil {
+		return
+	}
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			errs.add(path, "should be an object")
+			return
+		}
+		fields := map[string]reflect.Type{}
+		getConfigFields(typ, fields)
+		keys := make([]string, 0, len(item))
+		for key := range item {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldType, fnd := fields[key]
+			if !fnd {
+				errs.add(joinConfigPath(path, key), "unknown field")
+				continue
+			}
+			checkConfigFields(item[key], fieldType, joinConfigPath(path, key), errs)
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if !ok {
+			errs.add(path, "should be an array")
+			return
+		}
+		for i, item := range items {
+			checkConfigFields(item, typ.Elem(), fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case reflect.String:
+		if _, ok := value.(string); !ok {
+			errs.add(path, "should be a string")
+		}
+	case reflect.Bool:
+		if _, ok := value.(bool); !ok {
+			errs.add(path, "should be true or false")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, ok := value.(float64)
+		limit := math.Pow(2, float64(typ.Bits()-1))
+		if !ok || number != math.Trunc(number) || number < -limit || number >= limit {
+			errs.add(path, "should be an integer between %.0f and %.0f", -limit, limit-1)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, ok := value.(float64)
+		limit := math.Pow(2, float64(typ.Bits()))
+		if !ok || number != math.Trunc(number) || number < 0 || number >= limit {
+			errs.add(path, "should be an integer between 0 and %.0f", limit-1)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//range and cross field checks of the settings
+func validateSettings(set *SSettings, errs *SConfigErrors) {
+	if set.MaxConversations < 1 || set.MaxConversations > HashBucketSize*MaxConversationsPerBucket {
+		errs.add("max_conversation", "should be between 1 and %d", HashBucketSize*MaxConversationsPerBucket)
+	}
+	if set.MaxInactiveConversationLifeTime < 1 || set.MaxInactiveConversationLifeTime > MaxInactiveConversationLifeTime {
+		errs.add("max_inactive_conversation_life_time", "should be between 1 and %d seconds", MaxInactiveConversationLifeTime)
+	}
+	if GetTableFullPolicyName(GetTableFullPolicyNumber(set.TableFullPolicy)) != set.TableFullPolicy {
+		errs.add("conversation_table_full_policy", "should be evict, fail_closed or fail_open")
+	}
+	if set.EvictIdleTime > MaxInactiveConversationLifeTime {
+		errs.add("conversation_evict_idle_time", "should be between 0 and %d seconds", MaxInactiveConversationLifeTime)
+	}
+	if policy := GetTableFullPolicyNumber(set.EvictFallbackPolicy); policy == ConversationTableFullEvict || GetTableFullPolicyName(policy) != set.EvictFallbackPolicy {
+		errs.add("conversation_evict_fallback_policy", "should be fail_closed or fail_open")
+	}
+	if set.EventQueueSize < 1 || set.EventQueueSize > MaxEventQueueSize {
+		errs.add("event_queue_size", "should be between 1 and %d", MaxEventQueueSize)
+	}
+	if GetRuleEvaluationModeName(GetRuleEvaluationModeNumber(set.RuleEvaluationMode)) != set.RuleEvaluationMode {
+		errs.add("rule_evaluation_mode", "should be longest_prefix, priority or all")
+	}
+	if set.ActiveTimeSlice < 1 || set.ActiveTimeSlice > MaxActiveTimeSlice {
+		errs.add("active_time_slice", "should be between 1 and %d seconds", MaxActiveTimeSlice)
+	}
+	if GetSizeUnitsName(GetSizeUnitsNumber(set.SizeUnits)) != set.SizeUnits {
+		errs.add("size_units", "should be binary or si")
+	}
+	if set.RulesHistorySize < 1 || set.RulesHistorySize > MaxRulesHistorySize {
+		errs.add("rules_history_size", "should be between 1 and %d", MaxRulesHistorySize)
+	}
+	for i, item := range set.SubscriberNetworks {
+		if _, _, err := net.ParseCIDR(item); err != nil {
+			errs.add(fmt.Sprintf("subscriber_networks[%d]", i), "should be a network")
+		}
+	}
+
+	//the rules are loaded from the file, the database or the server
+	if len(set.RulesDatabase) > 0 && len(set.RulesUrl) > 0 {
+		errs.add("rules_url", "rules_database and rules_url can not be used together")
+	}
+	if len(set.RulesUrl) == 0 {
+		if len(set.RulesPublicKey) > 0 {
+			errs.add("rules_public_key", "needs rules_url")
+		}
+		if len(set.RulesCacheFile) > 0 {
+			errs.add("rules_cache_file", "needs rules_url")
+		}
+		return
+	}
+	if key, err := base64.StdEncoding.DecodeString(set.RulesPublicKey); err != nil || len(key) != ed25519.PublicKeySize {
+		errs.add("rules_public_key", "should be a base64 encoded ed25519 public key")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//check the rules with the matcher. the host names are not resolved and the duplicates are detected when the rules
+//are loaded. the groups and the pools of all, the file merged with its included files, could be used by the rules.
+//the MAC addresses need gw_mode and the sizes are parsed with size_units
+func validateRules(file *CJsonRuleRepository, all *CJsonRuleRepository, set *SSettings, errs *SConfigErrors) {
+	matcher := &CRuleMatcher{disableSourceMAC: !set.GWMode, sizeUnits: GetSizeUnitsNumber(set.SizeUnits)}
+
+	pools := map[string]*sQuotaPool{}
+	for i, p := range file.Pools {
+		if _, fnd := pools[p.Name]; fnd || len(p.Name) == 0 {
+			errs.add(fmt.Sprintf("pools[%d].name", i), "should be a unique name")
+		}
+		if _, err := parseSize(p.Size, matcher.sizeUnits); err != nil {
+			errs.add(fmt.Sprintf("pools[%d].size", i), err.Error())
+		}
+		pools[p.Name] = &sQuotaPool{Name: p.Name}
+	}
+
+	groups := map[string]SGroup{}
+	for i, g := range file.Groups {
+		if _, fnd := groups[g.Name]; fnd || len(g.Name) == 0 {
+			errs.add(fmt.Sprintf("groups[%d].name", i), "should be a unique name")
+		}
+		for j, member := range g.Members {
+			if _, err := net.ParseMAC(member); err == nil && !set.GWMode {
+				errs.add(fmt.Sprintf("groups[%d].members[%d]", i, j), "MAC addresses need gw_mode, the packets of the local mode have no source MAC")
+			}
+		}
+		groups[g.Name] = g
+	}
+	for _, p := range all.Pools {
+		if _, fnd := pools[p.Name]; !fnd {
+			pools[p.Name] = &sQuotaPool{Name: p.Name}
+		}
+	}
+	for _, g := range all.Groups {
+		if _, fnd := groups[g.Name]; !fnd {
+			groups[g.Name] = g
+		}
+	}
+
+	names := map[string]bool{}
+	hosts := map[string]*sResolvedHost{}
+	for i, rule := range file.Rules {
+		if names[rule.Name] || len(rule.Name) == 0 {
+			errs.add(fmt.Sprintf("rules[%d].name", i), "should be a unique name")
+		}
+		names[rule.Name] = true
+
+		if _, _, err := net.ParseCIDR(rule.Destination); err != nil {
+			if len(rule.Destination) == 0 {
+				errs.add(fmt.Sprintf("rules[%d].destination", i), "should be a network or a host name")
+				continue
+			}
+			hosts[rule.Destination] = &sResolvedHost{}
+		}
+		if _, err := matcher.compileRule(rule, hosts, groups, pools); err != nil {
+			ruleErr := new(SRuleError)
+			if errors.As(err, &ruleErr) {
+				errs.add(fmt.Sprintf("rules[%d].%s", i, ruleErr.Field), ruleErr.Reason)
+			} else {
+				errs.add(fmt.Sprintf("rules[%d]", i), err.Error())
+			}
+		}
+	}
+
+	for i, item := range file.Exempt {
+		if _, _, err := net.ParseCIDR(item); err != nil {
+			errs.add(fmt.Sprintf("exempt_networks[%d]", i), "should be a network")
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//decode the json strictly. the unknown fields and the invalid types are returned as the errors of the fields, the
+//other fields are decoded anyway so they can be checked too
+func decodeConfigStrict(data []byte, out interface{}) (SConfigErrors, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+
+	errs := SConfigErrors{}
+	checkConfigFields(value, reflect.TypeOf(sConfigFile{}), "", &errs)
+	if err := json.Unmarshal(data, out); err != nil && len(errs) == 0 {
+		return nil, err
+	}
+	return errs, nil
+}
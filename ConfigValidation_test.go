@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+func TestSettingsValidation(t *testing.T) {
+	settings := `
+	{
+		"max_conversations":1000,
+		"max_inactive_conversation_life_time":0,
+		"nfq_number":70000,
+		"gw_mode":"yes",
+		"conversation_table_full_policy":"drop",
+		"rules_public_key":"x",
+		"size_units":"iec",
+		"groups":[{"name":"kids","members":[5]},{"name":"pets","members":["aa:bb:cc:dd:ee:ff"]}],
+		"pools":[{"name":"family","size":"10xb"}],
+		"exempt_networks":["10.0.0.1"],
+		"rules":[
+			{"name":"first","destination":"10.0.0.0/8","protocol":"any","schedule":{"days":"mon"}},
+			{"name":"second","destination":"10.1.0.0/16","protocol":"any","usage_sise":"1kb","usage_size":"1xb"},
+			{"name":"second","destination":"example.com","protocol":"any","action":"mark"},
+			{"name":"third","destination":"10.2.0.0/16","protocol":"any","pool":"unknown"}
+		]
+	}`
+	fileName := filepath.Join(t.TempDir(), "setting.json")
+	if err := ioutil.WriteFile(fileName, []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadSettings(fileName)
+	errs := SConfigErrors{}
+	if !errors.As(err, &errs) {
+		t.Fatalf("invalid error %v", err)
+	}
+	paths := []string{}
+	for _, item := range errs {
+		paths = append(paths, item.Path)
+	}
+	sort.Strings(paths)
+	expected := []string{
+		"conversation_table_full_policy",
+		"exempt_networks[0]",
+		"groups[0].members[0]",
+		"groups[1].members[0]",
+		"gw_mode",
+		"max_conversations",
+		"max_inactive_conversation_life_time",
+		"nfq_number",
+		"pools[0].size",
+		"rules[0].schedule.days",
+		"rules[1].usage_sise",
+		"rules[1].usage_size",
+		"rules[2].mark",
+		"rules[2].name",
+		"rules[3].pool",
+		"rules_public_key",
+		"size_units",
+	}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("invalid errors\n%v", err)
+	}
+
+	//the rules repositories reject the unknown fields too
+	if _, err := CreateJsonRuleRepositoryFromStr(`{"rules":[{"name":"x","destination":"10.0.0.0/8","protocl":"any"}]}`); err == nil {
+		t.Fatal("unknown field should be rejected")
+	}
+	if _, err := CreateJsonRuleRepositoryFromStr(`{"$schema":"./schema/rules.schema.json","max_conversation":10,"rules":[{"name":"x","destination":"10.0.0.0/8"}]}`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//the schemas should have all the fields
+func TestConfigSchema(t *testing.T) {
+	loadSchema := func(fileName string) map[string]interface{} {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema := map[string]interface{}{}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			t.Fatal(err)
+		}
+		return schema
+	}
+	checkFields := func(name string, schema interface{}, typ reflect.Type) {
+		fields := map[string]reflect.Type{}
+		getConfigFields(typ, fields)
+		if name == "rules" {
+			fields["$schema"] = reflect.TypeOf("")
+		}
+		properties := schema.(map[string]interface{})["properties"].(map[string]interface{})
+		if len(properties) != len(fields) {
+			t.Fatalf("invalid fields of %s", name)
+		}
+		for key := range properties {
+			if _, fnd := fields[key]; !fnd {
+				t.Fatalf("unknown field %s of %s", key, name)
+			}
+		}
+	}
+
+	rules := loadSchema("schema/rules.schema.json")
+	definitions := rules["definitions"].(map[string]interface{})
+	checkFields("rules", rules, reflect.TypeOf(CJsonRuleRepository{}))
+	checkFields("rule", definitions["rule"], reflect.TypeOf(SRule{}))
+	checkFields("schedule", definitions["schedule"], reflect.TypeOf(SSchedule{}))
+	checkFields("group", definitions["group"], reflect.TypeOf(SGroup{}))
+	checkFields("pool", definitions["pool"], reflect.TypeOf(SPool{}))
+	checkFields("settings", loadSchema("schema/settings.schema.json"), reflect.TypeOf(sConfigFile{}))
+
+	//the examples of the quantities should be valid
+	for name, parse := range map[string]func(string) (int64, error){"size": parseSISize, "rate": parseRate, "duration": parseDuration} {
+		definition := definitions[name].(map[string]interface{})
+		pattern := regexp.MustCompile(definition["pattern"].(string))
+		for _, example := range definition["examples"].([]interface{}) {
+			if _, err := parse(example.(string)); err != nil || !pattern.MatchString(example.(string)) {
+				t.Fatalf("invalid example %s of %s", example, name)
+			}
+		}
+	}
+}
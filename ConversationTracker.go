@@ -5,21 +5,74 @@ import (
 	"encoding/json"
 	"log"
 	"net"
+	"sort"
+	"sync/atomic"
 	"time"
 )
 
 const HashBucketSize = 256000
 
+//subscribers hash table size
+const SubscriberHashBucketSize = 16384
+
+//number of segments sampled to find the least recently used conversation
+const EvictSampleCount = 16
+
+//conversations idle for this many seconds could be evicted when the table is full
+const DefaultEvictIdleTime = 60
+
+//minimum interval between two "table is full" logs
+const TableFullLogInterval = 10
+
+//---------------------------------------------------------------------------------------
+type SConversationTrackerStat struct {
+	Evicted     uint64 `json:"evicted"`
+	EvictFailed uint64 `json:"evict_failed"`
+	FailClosed  uint64 `json:"fail_closed"`
+	FailOpen    uint64 `json:"fail_open"`
+}
+
+//---------------------------------------------------------------------------------------
+//per packet update request. result holds a consistent copy of the updated conversation
+type sConversationUpdate struct {
+	packet     *SPacket
+	timeStamp  int64
+	updateFunc TConversationUpdateFunc
+	result     SConversationStatus
+}
+
 //---------------------------------------------------------------------------------------
 type CConversationTracker struct {
-	hashLinkList cHashLinkList
-	maxItems     uint32
+	cEventPublisher
+	hashLinkList    cHashLinkList
+	subscribers     cHashLinkList
+	maxItems        uint32
+	tableFullPolicy int
+	evictIdleTime   int64
+	evictFallback   int
+	stat            SConversationTrackerStat
+	lastFullLogTime int64
+	suppressedLogs  uint64
+	clock           IClock
+	activeTimeSlice int64
 }
 
 //---------------------------------------------------------------------------------------
 //remove inactive conversation
 func (thisPt *CConversationTracker) checkForRemove(ctime int64) {
-	thisPt.hashLinkList.CheckForTimeOut(nil, 0, ctime)
+	thisPt.hashLinkList.CheckForTimeOut(thisPt.onTimeOut, ctime, ctime)
+	thisPt.subscribers.CheckForTimeOut(nil, nil, ctime)
+}
+
+//---------------------------------------------------------------------------------------
+//userData is the time of the check
+func (thisPt *CConversationTracker) onTimeOut(inHashData interface{}, userData interface{}, delta int64) bool {
+	if thisPt.HasObserver() {
+		event := NewConversationEvent(ConversationEventEvicted, inHashData.(*SConversationStatus), userData.(int64))
+		event.Reason = "timeout"
+		thisPt.Publish(event)
+	}
+	return true
 }
 
 //---------------------------------------------------------------------------------------
@@ -27,7 +80,7 @@ func (thisPt *CConversationTracker) startTimeOutProcess() {
 	go func() {
 		for {
 			time.Sleep(100 * time.Millisecond)
-			thisPt.checkForRemove(time.Now().Unix())
+			thisPt.checkForRemove(thisPt.clock.Now().Unix())
 		}
 	}()
 }
@@ -55,6 +108,37 @@ func (thisPt *CConversationTracker) getKey(packet *SPacket) uint64 {
 	return key
 }
 
+//---------------------------------------------------------------------------------------
+func (thisPt *CConversationTracker) getIPKey(ip net.IP) uint64 {
+	if ip4 := ip.To4(); ip4 != nil {
+		return uint64(binary.LittleEndian.Uint32([]byte(ip4)))
+	}
+	data := []byte(ip.To16())
+	return binary.LittleEndian.Uint64(data[:8]) ^ binary.LittleEndian.Uint64(data[8:])
+}
+
+//---------------------------------------------------------------------------------------
+//conversations with the same key may collide, so the addresses should be checked too
+func (thisPt *CConversationTracker) compare(inHashData interface{}, userData interface{}) bool {
+	status := inHashData.(*SConversationStatus)
+	packet := userData.(*sConversationUpdate).packet
+	return (status.SrcIP.Equal(packet.SIp) && status.DstIP.Equal(packet.DIp)) ||
+		(status.SrcIP.Equal(packet.DIp) && status.DstIP.Equal(packet.SIp))
+}
+
+//---------------------------------------------------------------------------------------
+//called under the hash segment lock. updates the conversation and keeps a copy of it
+func (thisPt *CConversationTracker) update(inHashData interface{}, userData interface{}) {
+	status := inHashData.(*SConversationStatus)
+	update := userData.(*sConversationUpdate)
+	if update.updateFunc != nil {
+		update.updateFunc(status)
+	} else {
+		thisPt.updateStat(status, update.packet, update.timeStamp)
+	}
+	update.result = *status
+}
+
 //---------------------------------------------------------------------------------------
 func (thisPt *CConversationTracker) updateStat(info *SConversationStatus, packet *SPacket, timeStamp int64) {
 	var stat *SConversationProtocolStatus
@@ -67,37 +151,94 @@ func (thisPt *CConversationTracker) updateStat(info *SConversationStatus, packet
 	}
 
 	//update time stamp
+	if timeStamp == 0 {
+		timeStamp = thisPt.clock.Now().Unix()
+	}
 	if stat.StartTime == 0 {
-		if timeStamp == 0 {
-			timeStamp = time.Now().Unix()
-		}
 		stat.StartTime = timeStamp
 	}
+	if timeStamp > stat.LastSeen {
+		stat.LastSeen = timeStamp
+	}
 
 	if info.Direction(packet) == ConversationDirectionSend {
 		stat.Send += uint64(packet.DataSize)
+		stat.SendPackets++
 	} else {
 		stat.Receive += uint64(packet.DataSize)
+		stat.ReceivePackets++
+	}
+
+	stat.UpdateRate(uint64(packet.DataSize), timeStamp)
+	stat.UpdateActiveTime(timeStamp, thisPt.activeTimeSlice)
+	info.UpdateActiveTime(timeStamp, thisPt.activeTimeSlice)
+}
+
+//---------------------------------------------------------------------------------------
+//log the table full events at most once per TableFullLogInterval
+func (thisPt *CConversationTracker) logTableFull(outcome string) {
+	now := thisPt.clock.Now().Unix()
+	last := atomic.LoadInt64(&thisPt.lastFullLogTime)
+	if now-last < TableFullLogInterval || !atomic.CompareAndSwapInt64(&thisPt.lastFullLogTime, last, now) {
+		atomic.AddUint64(&thisPt.suppressedLogs, 1)
+		return
 	}
+	suppressed := atomic.SwapUint64(&thisPt.suppressedLogs, 0)
+	log.Printf("conversation table is full, %s (%d similar messages suppressed) \n", outcome, suppressed)
 }
 
 //---------------------------------------------------------------------------------------
-func (thisPt *CConversationTracker) createNew(packet *SPacket, timeStamp int64) (bool, SConversationStatus) {
-	//get conversation key
-	key := thisPt.getKey(packet)
+//apply the table full policy. returns true if there is room for the new conversation
+func (thisPt *CConversationTracker) handleTableFull(timeStamp int64) bool {
+	policy := thisPt.tableFullPolicy
+	if policy == ConversationTableFullEvict {
+		//the active conversations are never evicted, their quotas would be reset
+		if data := thisPt.hashLinkList.RemoveOldest(EvictSampleCount, timeStamp-thisPt.evictIdleTime); data != nil {
+			if thisPt.HasObserver() {
+				event := NewConversationEvent(ConversationEventEvicted, data.(*SConversationStatus), timeStamp)
+				event.Reason = "table_full"
+				thisPt.Publish(event)
+			}
+			atomic.AddUint64(&thisPt.stat.Evicted, 1)
+			thisPt.logTableFull("least recently used conversation evicted")
+			return true
+		}
+		atomic.AddUint64(&thisPt.stat.EvictFailed, 1)
+		policy = thisPt.evictFallback
+	}
+
+	switch policy {
+	case ConversationTableFullFailClosed:
+		atomic.AddUint64(&thisPt.stat.FailClosed, 1)
+		thisPt.logTableFull("new conversation dropped")
+	default:
+		atomic.AddUint64(&thisPt.stat.FailOpen, 1)
+		thisPt.logTableFull("new conversation passed without tracking")
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CConversationTracker) createNew(key uint64, update *sConversationUpdate) (bool, SConversationStatus) {
+	timeStamp := update.timeStamp
+	if timeStamp == 0 {
+		timeStamp = thisPt.clock.Now().Unix()
+	}
 
 	//check for max track table
-	if thisPt.hashLinkList.GetItemsCount() > thisPt.maxItems {
-		log.Printf("conversation table is full \n")
+	if thisPt.hashLinkList.GetItemsCount() > thisPt.maxItems && !thisPt.handleTableFull(timeStamp) {
 		return false, SConversationStatus{}
 	}
 
+	//another packet of the same conversation may add it in the meantime, in that case it will be updated
 	status := new(SConversationStatus)
-	status.SrcIP = packet.SIp
-	status.DstIP = packet.DIp
-	thisPt.hashLinkList.Add(key, status)
-	thisPt.updateStat(status, packet, timeStamp)
-	return true, *status
+	status.SrcIP = update.packet.SIp
+	status.DstIP = update.packet.DIp
+	status.SrcMAC = update.packet.SrcMAC
+	if thisPt.hashLinkList.AddOrUpdate(key, status, thisPt.compare, thisPt.update, update) == status && thisPt.HasObserver() {
+		thisPt.Publish(NewConversationEvent(ConversationEventCreated, &update.result, timeStamp))
+	}
+	return true, update.result
 }
 
 //---------------------------------------------------------------------------------------
@@ -108,12 +249,72 @@ func (thisPt *CConversationTracker) GetStatus(packet *SPacket, timeStamp int64)
 	key := thisPt.getKey(packet)
 
 	//add or update
-	if data := thisPt.hashLinkList.Find(key, nil, nil); data != nil {
-		status := data.(*SConversationStatus)
-		thisPt.updateStat(status, packet, timeStamp)
-		return true, *status
+	update := &sConversationUpdate{packet: packet, timeStamp: timeStamp}
+	if data := thisPt.hashLinkList.FindAndUpdate(key, thisPt.compare, thisPt.update, update); data != nil {
+		return true, update.result
 	}
-	return thisPt.createNew(packet, timeStamp)
+	return thisPt.createNew(key, update)
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IConversationTracker.Update
+func (thisPt *CConversationTracker) Update(packet *SPacket, updateFunc TConversationUpdateFunc) bool {
+	update := &sConversationUpdate{packet: packet, updateFunc: updateFunc}
+	return thisPt.hashLinkList.FindAndUpdate(thisPt.getKey(packet), thisPt.compare, thisPt.update, update) != nil
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IConversationTracker.UpdateSubscriber
+func (thisPt *CConversationTracker) UpdateSubscriber(ip net.IP, updateFunc TSubscriberUpdateFunc) bool {
+	key := thisPt.getIPKey(ip)
+
+	compare := func(inHashData interface{}, userData interface{}) bool {
+		return inHashData.(*SSubscriberStatus).IP.Equal(ip)
+	}
+	update := func(inHashData interface{}, userData interface{}) {
+		updateFunc(inHashData.(*SSubscriberStatus))
+	}
+
+	if thisPt.subscribers.FindAndUpdate(key, compare, update, nil) != nil {
+		return true
+	}
+
+	//there is not any subscriber without a conversation, so the conversations limit is enough
+	if thisPt.subscribers.GetItemsCount() > thisPt.maxItems {
+		return false
+	}
+
+	status := new(SSubscriberStatus)
+	status.IP = ip
+	status.Buckets = map[string]*STokenBucket{}
+	thisPt.subscribers.AddOrUpdate(key, status, compare, update, nil)
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IConversationTracker.GetTableFullPolicy
+//the policy of the conversations that can not be tracked, the fallback policy if the table full policy is evict
+func (thisPt *CConversationTracker) GetTableFullPolicy() int {
+	if thisPt.tableFullPolicy == ConversationTableFullEvict {
+		return thisPt.evictFallback
+	}
+	return thisPt.tableFullPolicy
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IConversationTracker.SetEvictPolicy
+//just the conversations idle for idleTime seconds are evicted, fallbackPolicy is applied if there is not any.
+//it should be set before the first packet
+func (thisPt *CConversationTracker) SetEvictPolicy(idleTime int64, fallbackPolicy int) {
+	thisPt.evictIdleTime = idleTime
+	thisPt.evictFallback = fallbackPolicy
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IConversationTracker.SetActiveTimeSlice
+//the slice length of the active time accounting, it should be set before the first packet
+func (thisPt *CConversationTracker) SetActiveTimeSlice(seconds int64) {
+	thisPt.activeTimeSlice = seconds
 }
 
 //---------------------------------------------------------------------------------------
@@ -124,30 +325,94 @@ func (thisPt *CConversationTracker) Dump() string {
 		For simplicity, we ignore any search query and maximum row count
 	*/
 
+	out := thisPt.getAll(thisPt.clock.Now().Unix())
+
+	//convert to json
+	jsonRes, _ := json.Marshal(out)
+	return string(jsonRes)
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IConversationTracker.DumpTop
+func (thisPt *CConversationTracker) DumpTop(count int) string {
+	now := thisPt.clock.Now().Unix()
+	out := thisPt.getAll(now)
+
+	//sort by current rate, the heavy hitters first
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].CurrentRate(now) > out[j].CurrentRate(now)
+	})
+	if count > 0 && len(out) > count {
+		out = out[:count]
+	}
+
+	//convert to json
+	jsonRes, _ := json.Marshal(out)
+	return string(jsonRes)
+}
+
+//---------------------------------------------------------------------------------------
+//return a copy of all the conversations with up to date rates
+func (thisPt *CConversationTracker) getAll(timeStamp int64) []SConversationStatus {
 	out := []SConversationStatus{}
 
 	callBack := func(inHashData interface{}) bool {
-		status := inHashData.(*SConversationStatus)
-		out = append(out, *status)
+		status := *inHashData.(*SConversationStatus)
+		status.TCPStatus.Rate = status.TCPStatus.CurrentRate(timeStamp)
+		status.UDPStatus.Rate = status.UDPStatus.CurrentRate(timeStamp)
+		status.OtherStatus.Rate = status.OtherStatus.CurrentRate(timeStamp)
+		out = append(out, status)
 		return true
 	}
 	thisPt.hashLinkList.Iterate(callBack)
+	return out
+}
 
-	//convert to json
-	jsonRes, _ := json.Marshal(out)
+//---------------------------------------------------------------------------------------
+// implement  IConversationTracker.DumpStat
+func (thisPt *CConversationTracker) DumpStat() string {
+	stat := struct {
+		SConversationTrackerStat
+		Items           uint32 `json:"items"`
+		MaxItems        uint32 `json:"max_items"`
+		TableFullPolicy string `json:"table_full_policy"`
+	}{}
+
+	stat.Evicted = atomic.LoadUint64(&thisPt.stat.Evicted)
+	stat.EvictFailed = atomic.LoadUint64(&thisPt.stat.EvictFailed)
+	stat.FailClosed = atomic.LoadUint64(&thisPt.stat.FailClosed)
+	stat.FailOpen = atomic.LoadUint64(&thisPt.stat.FailOpen)
+	stat.Items = thisPt.hashLinkList.GetItemsCount()
+	stat.MaxItems = thisPt.maxItems
+	stat.TableFullPolicy = GetTableFullPolicyName(thisPt.tableFullPolicy)
+
+	jsonRes, _ := json.Marshal(stat)
 	return string(jsonRes)
 }
 
 //---------------------------------------------------------------------------------------
-//create tracker object
-func CreateConversationTracker(inactivityTimeOut int64, maxItems uint32) IConversationTracker {
+//create tracker object. the system clock is used if clock is nil
+func CreateConversationTracker(inactivityTimeOut int64, maxItems uint32, tableFullPolicy int, clock IClock) IConversationTracker {
 
 	tracker := new(CConversationTracker)
+	tracker.clock = clock
+	if tracker.clock == nil {
+		tracker.clock = CSystemClock{}
+	}
+	tracker.hashLinkList.clock = tracker.clock
+	tracker.subscribers.clock = tracker.clock
 	if !tracker.hashLinkList.Init(HashBucketSize, inactivityTimeOut) {
 		log.Fatalln("can not init hash linklist")
 	}
+	if !tracker.subscribers.Init(SubscriberHashBucketSize, inactivityTimeOut) {
+		log.Fatalln("can not init hash linklist")
+	}
 
 	tracker.maxItems = maxItems
+	tracker.tableFullPolicy = tableFullPolicy
+	tracker.activeTimeSlice = DefaultActiveTimeSlice
+	tracker.evictIdleTime = DefaultEvictIdleTime
+	tracker.evictFallback = ConversationTableFullFailOpen
 	tracker.hashLinkList.minInActiveTime = inactivityTimeOut
 
 	//init inactive conversations remove goroutine
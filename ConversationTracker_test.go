@@ -3,13 +3,14 @@ package main
 import (
 	"log"
 	"net"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestConversationTracker(t *testing.T) {
 
-	conv := CreateConversationTracker(3600, 64)
+	conv := CreateConversationTracker(3600, 64, ConversationTableFullEvict, nil)
 	//create dummy packet
 	packet := SPacket{}
 
@@ -71,3 +72,176 @@ func TestConversationTracker(t *testing.T) {
 	}
 
 }
+
+func TestConversationTableFull(t *testing.T) {
+
+	fillTable := func(conv IConversationTracker) SPacket {
+		packet := SPacket{}
+		packet.SIp = net.ParseIP("192.168.1.1").To4()
+		packet.DataSize = 50
+		packet.IpVersion = 4
+		packet.Protocol = PROTOCOL_TCP
+		for i := 0; i < 3; i++ {
+			packet.DIp = net.IPv4(10, 0, 0, byte(i+1)).To4()
+			if res, _ := conv.GetStatus(&packet, 0); !res {
+				t.Fatal("test failed")
+			}
+		}
+		packet.DIp = net.ParseIP("10.0.1.1").To4()
+		return packet
+	}
+
+	//evict, just the idle conversations are evicted
+	clock := &cFakeClock{now: time.Unix(1000000, 0)}
+	conv := CreateConversationTracker(3600, 2, ConversationTableFullEvict, clock)
+	packet := fillTable(conv)
+	clock.Set(clock.Now().Add(30 * time.Second))
+	if res, _ := conv.GetStatus(&packet, 0); res {
+		t.Fatal("active conversation evicted")
+	}
+	convInt := conv.(*CConversationTracker)
+	if convInt.stat.EvictFailed != 1 || convInt.stat.FailOpen != 1 || conv.GetTableFullPolicy() != ConversationTableFullFailOpen {
+		t.Fatal("invalid eviction fallback stat")
+	}
+	clock.Set(clock.Now().Add(DefaultEvictIdleTime * time.Second))
+	if res, _ := conv.GetStatus(&packet, 0); !res {
+		t.Fatal("eviction failed")
+	}
+	if convInt.stat.Evicted != 1 || convInt.hashLinkList.GetItemsCount() != 3 {
+		t.Fatal("invalid eviction stat")
+	}
+
+	//evict with the fail closed fallback
+	conv = CreateConversationTracker(3600, 2, ConversationTableFullEvict, nil)
+	conv.SetEvictPolicy(DefaultEvictIdleTime, ConversationTableFullFailClosed)
+	packet = fillTable(conv)
+	if res, _ := conv.GetStatus(&packet, 0); res {
+		t.Fatal("active conversation evicted")
+	}
+	if conv.(*CConversationTracker).stat.FailClosed != 1 || conv.GetTableFullPolicy() != ConversationTableFullFailClosed {
+		t.Fatal("invalid eviction fallback stat")
+	}
+
+	//fail closed
+	conv = CreateConversationTracker(3600, 2, ConversationTableFullFailClosed, nil)
+	packet = fillTable(conv)
+	if res, _ := conv.GetStatus(&packet, 0); res {
+		t.Fatal("fail closed failed")
+	}
+	if conv.(*CConversationTracker).stat.FailClosed != 1 {
+		t.Fatal("invalid fail closed stat")
+	}
+
+	//fail open
+	conv = CreateConversationTracker(3600, 2, ConversationTableFullFailOpen, nil)
+	packet = fillTable(conv)
+	if res, _ := conv.GetStatus(&packet, 0); res {
+		t.Fatal("fail open failed")
+	}
+	if conv.(*CConversationTracker).stat.FailOpen != 1 {
+		t.Fatal("invalid fail open stat")
+	}
+
+	log.Printf("\n %s \n", conv.DumpStat())
+}
+
+func TestConversationRate(t *testing.T) {
+
+	conv := CreateConversationTracker(3600, 64, ConversationTableFullEvict, nil)
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.1.1").To4()
+	packet.DIp = net.ParseIP("192.168.1.2").To4()
+	packet.DataSize = 1000
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_UDP
+
+	start := time.Now().Unix() - 100
+
+	//10 packets per second for 10 seconds
+	var stat SConversationStatus
+	for i := int64(0); i < 100; i++ {
+		_, stat = conv.GetStatus(&packet, start+i/10)
+	}
+
+	if stat.UDPStatus.SendPackets != 100 || stat.TotalPackets() != 100 {
+		t.Fatal("invalid packet count")
+	}
+
+	if stat.UDPStatus.StartTime != start || stat.UDPStatus.LastSeen != start+9 {
+		t.Fatal("invalid time stamps")
+	}
+
+	//the rate should converge to 80kbps
+	rate := stat.CurrentRate(start + 10)
+	if rate < 70000 || rate > 80000 {
+		t.Fatalf("invalid rate %f", rate)
+	}
+
+	//and decay when the conversation is idle
+	if stat.CurrentRate(start+30) > rate/100 {
+		t.Fatal("invalid idle rate")
+	}
+}
+
+//run with -race
+func TestConversationTrackerConcurrency(t *testing.T) {
+
+	const workers = 16
+	const packets = 2000
+	const conversations = 8
+
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+
+	stop := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				conv.Dump()
+				conv.DumpTop(4)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			packet := SPacket{}
+			packet.IpVersion = 4
+			packet.Protocol = PROTOCOL_UDP
+			packet.DataSize = 10
+			for i := 0; i < packets; i++ {
+				packet.SIp = net.IPv4(192, 168, 1, byte(i%conversations)).To4()
+				packet.DIp = net.IPv4(10, 0, 0, 1).To4()
+				//half of the workers simulate the receive direction
+				if w%2 == 1 {
+					packet.SIp, packet.DIp = packet.DIp, packet.SIp
+				}
+				if res, _ := conv.GetStatus(&packet, 0); !res {
+					t.Error("test failed")
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+
+	convInt := conv.(*CConversationTracker)
+	if convInt.hashLinkList.GetItemsCount() != conversations {
+		t.Fatal("invalid item count")
+	}
+
+	total := uint64(0)
+	convInt.hashLinkList.Iterate(func(inHashData interface{}) bool {
+		total += inHashData.(*SConversationStatus).TotalPackets()
+		return true
+	})
+	if total != workers*packets {
+		t.Fatalf("lost updates, %d of %d packets counted", total, workers*packets)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+)
+
+//---------------------------------------------------------------------------------------
+type SEventDispatcherStatus struct {
+	Published uint64 `json:"published"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+	QueueSize int    `json:"queue_size"`
+}
+
+//---------------------------------------------------------------------------------------
+//CEventDispatcher implements IConversationObserver. events are queued in a bounded queue and delivered
+//to the observers from a separate goroutine, so slow observers can not stall the packet processing.
+//when the queue is full, new events are dropped
+type CEventDispatcher struct {
+	queue     chan *SConversationEvent
+	observers []IConversationObserver
+	lock      sync.RWMutex
+	stat      SEventDispatcherStatus
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CEventDispatcher) run() {
+	for event := range thisPt.queue {
+		thisPt.lock.RLock()
+		for _, observer := range thisPt.observers {
+			observer.OnConversationEvent(event)
+		}
+		thisPt.lock.RUnlock()
+		atomic.AddUint64(&thisPt.stat.Delivered, 1)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CEventDispatcher) AddObserver(observer IConversationObserver) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	thisPt.observers = append(thisPt.observers, observer)
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IConversationObserver.OnConversationEvent
+func (thisPt *CEventDispatcher) OnConversationEvent(event *SConversationEvent) {
+	atomic.AddUint64(&thisPt.stat.Published, 1)
+	select {
+	case thisPt.queue <- event:
+	default:
+		atomic.AddUint64(&thisPt.stat.Dropped, 1)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CEventDispatcher) Dump() string {
+	stat := SEventDispatcherStatus{}
+	stat.Published = atomic.LoadUint64(&thisPt.stat.Published)
+	stat.Delivered = atomic.LoadUint64(&thisPt.stat.Delivered)
+	stat.Dropped = atomic.LoadUint64(&thisPt.stat.Dropped)
+	stat.QueueSize = cap(thisPt.queue)
+	out, _ := json.Marshal(stat)
+	return string(out)
+}
+
+//---------------------------------------------------------------------------------------
+func CreateEventDispatcher(queueSize int) *CEventDispatcher {
+	dispatcher := new(CEventDispatcher)
+	dispatcher.queue = make(chan *SConversationEvent, queueSize)
+	go dispatcher.run()
+	return dispatcher
+}
+
+//---------------------------------------------------------------------------------------
+//observer reference that could be replaced while the packets are processed
+type cEventPublisher struct {
+	observer atomic.Value
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cEventPublisher) SetObserver(observer IConversationObserver) {
+	thisPt.observer.Store(&observer)
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cEventPublisher) getObserver() IConversationObserver {
+	if observer, _ := thisPt.observer.Load().(*IConversationObserver); observer != nil {
+		return *observer
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cEventPublisher) HasObserver() bool {
+	return thisPt.getObserver() != nil
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cEventPublisher) Publish(event *SConversationEvent) {
+	if observer := thisPt.getObserver(); observer != nil {
+		observer.OnConversationEvent(event)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type cChannelObserver chan *SConversationEvent
+
+func (thisPt cChannelObserver) OnConversationEvent(event *SConversationEvent) {
+	thisPt <- event
+}
+
+func TestEventDispatcher(t *testing.T) {
+
+	//a blocked observer should not block the publisher
+	blocked := make(cChannelObserver)
+	dispatcher := CreateEventDispatcher(2)
+	dispatcher.AddObserver(blocked)
+
+	status := SConversationStatus{}
+	for i := 0; i < 10; i++ {
+		dispatcher.OnConversationEvent(NewConversationEvent(ConversationEventCreated, &status, 0))
+	}
+	if dispatcher.stat.Dropped == 0 {
+		t.Fatal("events should be dropped")
+	}
+
+	//check the events of a conversation
+	rules := `
+	{
+		"rules":[
+			{
+				"name":"test1",
+				"destination":"192.168.1.0/24",
+				"usage_size":"2kb",
+				"protocol" : "any"
+			}
+		]
+	}
+	`
+	events := make(cChannelObserver, 16)
+	dispatcher = CreateEventDispatcher(16)
+	dispatcher.AddObserver(events)
+
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, nil)
+	conv.SetObserver(dispatcher)
+	matcher.SetObserver(dispatcher)
+
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("192.168.1.2").To4()
+	packet.Protocol = PROTOCOL_TCP
+	packet.IpVersion = 4
+	packet.DataSize = 1100
+
+	for i := 0; i < 3; i++ {
+		matcher.Match(&packet, 0)
+	}
+
+	expected := []string{"created", "quota_threshold", "quota_threshold", "first_drop"}
+	for _, name := range expected {
+		select {
+		case event := <-events:
+			if event.Event != name || event.RuleName != "test1" && name != "created" {
+				t.Fatalf("invalid event %s, expected %s", event.Event, name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("missing event %s", name)
+		}
+	}
+
+	//check json lines sink
+	out := bytes.Buffer{}
+	sink := CreateJsonLinesEventSink(&out)
+	sink.OnConversationEvent(NewConversationEvent(ConversationEventFirstDrop, &status, 1000))
+	sink.OnConversationEvent(NewConversationEvent(ConversationEventEvicted, &status, 1000))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatal("invalid json lines")
+	}
+	event := SConversationEvent{}
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || event.Event != "evicted" || event.Time != 1000 {
+		t.Fatal("invalid json line")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+//---------------------------------------------------------------------------------------
+//json lines event sink implement IConversationObserver. every event is written as a single JSON line
+type CJsonLinesEventSink struct {
+	writer io.Writer
+	lock   sync.Mutex
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IConversationObserver.OnConversationEvent
+func (thisPt *CJsonLinesEventSink) OnConversationEvent(event *SConversationEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	if _, err := thisPt.writer.Write(append(data, '\n')); err != nil {
+		log.Printf("can not write event, %v \n", err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+func CreateJsonLinesEventSink(writer io.Writer) IConversationObserver {
+	sink := new(CJsonLinesEventSink)
+	sink.writer = writer
+	return sink
+}
+
+//---------------------------------------------------------------------------------------
+//create a sink that appends the events to a file
+func CreateJsonLinesFileEventSink(fileName string) (IConversationObserver, error) {
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return CreateJsonLinesEventSink(file), nil
+}
@@ -19,6 +19,9 @@ type THashTimeOutFunc func(inHashData interface{}, userdata interface{}, delta i
 //THashTimeOutFunc ...
 type THashIterationFunc func(inHashData interface{}) bool
 
+//THashUpdateFunc ...
+type THashUpdateFunc func(inHashData interface{}, userdata interface{})
+
 //---------------------------------------------------------------------------------------
 type sHashLinkListNode struct {
 	Key            uint64
@@ -41,10 +44,14 @@ type cHashLinkList struct {
 	itemCount        int32
 	lastCheckSegment uint32
 	minInActiveTime  int64
+	clock            IClock
 }
 
 //---------------------------------------------------------------------------------------
 func (thisPt *cHashLinkList) getTime() int64 {
+	if thisPt.clock != nil {
+		return thisPt.clock.Now().Unix()
+	}
 	return time.Now().Unix()
 }
 
@@ -82,8 +89,11 @@ func (thisPt *cHashLinkList) Iterate(callBack THashIterationFunc) uint32 {
 
 func (thisPt *cHashLinkList) Init(segmentCount int, minInActiveTime int64) bool {
 
-	//initialize segments
+	//initialize segments. segments are allocated here to avoid racing on the lazy creation
 	thisPt.segments = make([]*sHashLinkListSegment, segmentCount)
+	for i := range thisPt.segments {
+		thisPt.segments[i] = &sHashLinkListSegment{}
+	}
 	thisPt.minInActiveTime = minInActiveTime
 	return true
 }
@@ -91,19 +101,19 @@ func (thisPt *cHashLinkList) Init(segmentCount int, minInActiveTime int64) bool
 //---------------------------------------------------------------------------------------
 
 func (thisPt *cHashLinkList) Add(key uint64, data interface{}) {
-	index := thisPt.getIndex(key)
-	segment := thisPt.segments[index]
-
-	//check for valid segment
-	if segment == nil {
-		thisPt.segments[index] = &sHashLinkListSegment{}
-		segment = thisPt.segments[index]
-	}
+	segment := thisPt.segments[thisPt.getIndex(key)]
 
 	//lock segment
 	segment.Lock.Lock()
 	defer segment.Lock.Unlock()
 
+	thisPt.addNode(segment, key, data)
+}
+
+//---------------------------------------------------------------------------------------
+
+//should be called with the segment write lock
+func (thisPt *cHashLinkList) addNode(segment *sHashLinkListSegment, key uint64, data interface{}) {
 	//create node
 	node := &sHashLinkListNode{}
 	node.Data = data
@@ -174,12 +184,65 @@ func (thisPt *cHashLinkList) Find(key uint64, cmpFunc THashCompareFunc, userData
 	defer segment.Lock.RUnlock()
 
 	//check node
+	for node := segment.Head; node != nil; node = node.Next {
+		if node.Key == key {
+			if cmpFunc != nil && cmpFunc(node.Data, userData) == false {
+				continue
+			}
+			atomic.StoreInt64(&node.LastAccessTime, thisPt.getTime())
+			return node.Data
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
+//FindAndUpdate . find the data and call updateFunc while the segment is locked for write
+func (thisPt *cHashLinkList) FindAndUpdate(key uint64, cmpFunc THashCompareFunc, updateFunc THashUpdateFunc, userData interface{}) interface{} {
+	segment := thisPt.segments[thisPt.getIndex(key)]
+
+	//lock segment
+	segment.Lock.Lock()
+	defer segment.Lock.Unlock()
+
+	return thisPt.updateNode(segment, key, cmpFunc, updateFunc, userData)
+}
+
+//---------------------------------------------------------------------------------------
+
+//AddOrUpdate . same as FindAndUpdate, but adds the data if it can not find the key. returns the stored data
+func (thisPt *cHashLinkList) AddOrUpdate(key uint64, data interface{}, cmpFunc THashCompareFunc, updateFunc THashUpdateFunc, userData interface{}) interface{} {
+	segment := thisPt.segments[thisPt.getIndex(key)]
+
+	//lock segment
+	segment.Lock.Lock()
+	defer segment.Lock.Unlock()
+
+	if found := thisPt.updateNode(segment, key, cmpFunc, updateFunc, userData); found != nil {
+		return found
+	}
+
+	if updateFunc != nil {
+		updateFunc(data, userData)
+	}
+	thisPt.addNode(segment, key, data)
+	return data
+}
+
+//---------------------------------------------------------------------------------------
+
+//should be called with the segment write lock
+func (thisPt *cHashLinkList) updateNode(segment *sHashLinkListSegment, key uint64, cmpFunc THashCompareFunc, updateFunc THashUpdateFunc, userData interface{}) interface{} {
 	for node := segment.Head; node != nil; node = node.Next {
 		if node.Key == key {
 			if cmpFunc != nil && cmpFunc(node.Data, userData) == false {
 				continue
 			}
 			node.LastAccessTime = thisPt.getTime()
+			if updateFunc != nil {
+				updateFunc(node.Data, userData)
+			}
 			return node.Data
 		}
 	}
@@ -190,8 +253,7 @@ func (thisPt *cHashLinkList) Find(key uint64, cmpFunc THashCompareFunc, userData
 
 func (thisPt *cHashLinkList) CheckForTimeOut(cmpFunc THashTimeOutFunc, userData interface{}, t int64) int {
 	//find last segment
-	index := thisPt.lastCheckSegment % uint32(len(thisPt.segments))
-	atomic.AddUint32(&thisPt.lastCheckSegment, 1)
+	index := (atomic.AddUint32(&thisPt.lastCheckSegment, 1) - 1) % uint32(len(thisPt.segments))
 
 	//
 	segment := thisPt.segments[index]
@@ -237,18 +299,101 @@ func (thisPt *cHashLinkList) CheckForTimeOut(cmpFunc THashTimeOutFunc, userData
 
 //---------------------------------------------------------------------------------------
 
+//RemoveOldest . approximate LRU removal. it samples up to sampleCount non-empty segments, starting from the
+//last checked segment, and removes the least recently accessed node among them if it is not accessed after
+//maxAccessTime. returns the removed data
+func (thisPt *cHashLinkList) RemoveOldest(sampleCount int, maxAccessTime int64) interface{} {
+	segmentCount := uint32(len(thisPt.segments))
+	start := atomic.AddUint32(&thisPt.lastCheckSegment, 1)
+
+	var oldestSegment *sHashLinkListSegment
+	var oldestNode *sHashLinkListNode
+	var oldestTime int64
+
+	//limit the scan length to roughly twice the expected distance of sampleCount items
+	itemCount := uint64(atomic.LoadInt32(&thisPt.itemCount))
+	if itemCount == 0 {
+		itemCount = 1
+	}
+	maxScan := uint32(segmentCount)
+	if scan := 2 * uint64(sampleCount) * uint64(segmentCount) / itemCount; scan < uint64(maxScan) {
+		maxScan = uint32(scan)
+	}
+
+	sampled := 0
+	for i := uint32(0); i < maxScan && sampled < sampleCount; i++ {
+		segment := thisPt.segments[(start+i)%segmentCount]
+		if segment == nil {
+			continue
+		}
+
+		segment.Lock.RLock()
+		if segment.Head != nil {
+			sampled++
+		}
+		for node := segment.Head; node != nil; node = node.Next {
+			accessTime := atomic.LoadInt64(&node.LastAccessTime)
+			if accessTime > maxAccessTime {
+				continue
+			}
+			if oldestNode == nil || accessTime < oldestTime {
+				oldestSegment = segment
+				oldestNode = node
+				oldestTime = accessTime
+			}
+		}
+		segment.Lock.RUnlock()
+	}
+
+	if oldestNode == nil {
+		return nil
+	}
+
+	//the node may be removed or touched in the meantime
+	oldestSegment.Lock.Lock()
+	defer oldestSegment.Lock.Unlock()
+
+	var pNode *sHashLinkListNode
+	for node := oldestSegment.Head; node != nil; node = node.Next {
+		if node == oldestNode {
+			if node.LastAccessTime != oldestTime {
+				return nil
+			}
+			data := node.Data
+			node.Data = nil
+			if pNode != nil {
+				pNode.Next = node.Next
+			} else {
+				oldestSegment.Head = node.Next
+			}
+			node.Next = nil
+			//
+			atomic.AddInt32(&thisPt.itemCount, -1)
+			return data
+		}
+		pNode = node
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+
 //Clear for IHashLinkList
 func (thisPt *cHashLinkList) Clear() {
-	for i := 0; i < len(thisPt.segments); i++ {
-		thisPt.segments[i] = nil
+	for _, segment := range thisPt.segments {
+		segment.Lock.Lock()
+		for node := segment.Head; node != nil; node = node.Next {
+			atomic.AddInt32(&thisPt.itemCount, -1)
+		}
+		segment.Head = nil
+		segment.Lock.Unlock()
 	}
-	thisPt.itemCount = 0
-	thisPt.lastCheckSegment = 0
+	atomic.StoreUint32(&thisPt.lastCheckSegment, 0)
 }
 
 //---------------------------------------------------------------------------------------
 
 //GetItemsCount for IHashLinkList
 func (thisPt *cHashLinkList) GetItemsCount() uint32 {
-	return uint32(thisPt.itemCount)
+	return uint32(atomic.LoadInt32(&thisPt.itemCount))
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//timeout of each request to the rules server
+const HttpRulesTimeout = 30 * time.Second
+
+//---------------------------------------------------------------------------------------
+//rules repository fetched from a server. the rules are signed with ed25519, the signature is fetched from
+//url + ".sig" and could be raw or base64 encoded. the last verified copy is cached on the disk and used when
+//the server is not reachable
+type CHttpRuleRepository struct {
+	url       string
+	publicKey ed25519.PublicKey
+	cacheFile string
+	client    *http.Client
+	lock      sync.RWMutex
+	fetchLock sync.Mutex
+	rules     *CJsonRuleRepository
+	etag      string
+	changes   chan struct{}
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CHttpRuleRepository) get(url string, etag string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(etag) > 0 {
+		req.Header.Set("If-None-Match", etag)
+	}
+	return thisPt.client.Do(req)
+}
+
+//---------------------------------------------------------------------------------------
+func readHttpBody(resp *http.Response) ([]byte, error) {
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid response %s from %s", resp.Status, resp.Request.URL)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, MAX_FILE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_FILE_SIZE {
+		return nil, errors.New("invalid rule file size")
+	}
+	return data, nil
+}
+
+//---------------------------------------------------------------------------------------
+//check the signature and parse the rules
+func (thisPt *CHttpRuleRepository) verify(data []byte, signature []byte) (*CJsonRuleRepository, error) {
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil {
+			return nil, errors.New("invalid rules signature")
+		}
+		signature = decoded
+	}
+	if len(signature) != ed25519.SignatureSize || !ed25519.Verify(thisPt.publicKey, data, signature) {
+		return nil, errors.New("invalid rules signature")
+	}
+
+	//the format is detected by the url or the content
+	data, err := decodeConfig(data, detectConfigFormat(thisPt.url, data))
+	if err != nil {
+		return nil, err
+	}
+	rules := new(CJsonRuleRepository)
+	if err := rules.loadRulesFromString(string(data)); err != nil {
+		return nil, err
+	}
+	if len(rules.Include) > 0 {
+		return nil, newRuleError("", "include", "the files could be included just by the rules files")
+	}
+	//the cached copy has the origin of the server too
+	for i := range rules.Rules {
+		rules.Rules[i].Origin = thisPt.url
+	}
+	return rules, nil
+}
+
+//---------------------------------------------------------------------------------------
+//the files are replaced, so a crash does not leave a partial copy
+func writeFileAtomic(fileName string, data []byte) error {
+	tempName := fileName + ".tmp"
+	if err := ioutil.WriteFile(tempName, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tempName, fileName)
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CHttpRuleRepository) saveCache(data []byte, signature []byte) {
+	if len(thisPt.cacheFile) == 0 {
+		return
+	}
+	err := writeFileAtomic(thisPt.cacheFile+".sig", signature)
+	if err == nil {
+		err = writeFileAtomic(thisPt.cacheFile, data)
+	}
+	if err != nil {
+		log.Printf("can not cache the rules, %v \n", err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CHttpRuleRepository) loadCache() error {
+	if len(thisPt.cacheFile) == 0 {
+		return errors.New("rules cache is not defined")
+	}
+	data, err := ioutil.ReadFile(thisPt.cacheFile)
+	if err != nil {
+		return err
+	}
+	signature, err := ioutil.ReadFile(thisPt.cacheFile + ".sig")
+	if err != nil {
+		return err
+	}
+	rules, err := thisPt.verify(data, signature)
+	if err != nil {
+		return fmt.Errorf("invalid rules cache, %v", err)
+	}
+
+	thisPt.lock.Lock()
+	thisPt.rules = rules
+	thisPt.lock.Unlock()
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+//fetch the rules if they are changed. returns true if new rules are loaded
+func (thisPt *CHttpRuleRepository) refresh() (bool, error) {
+	thisPt.fetchLock.Lock()
+	defer thisPt.fetchLock.Unlock()
+
+	resp, err := thisPt.get(thisPt.url, thisPt.etag)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	data, err := readHttpBody(resp)
+	if err != nil {
+		return false, err
+	}
+
+	sigResp, err := thisPt.get(thisPt.url+".sig", "")
+	if err != nil {
+		return false, err
+	}
+	defer sigResp.Body.Close()
+	signature, err := readHttpBody(sigResp)
+	if err != nil {
+		return false, err
+	}
+
+	rules, err := thisPt.verify(data, signature)
+	if err != nil {
+		return false, err
+	}
+	thisPt.saveCache(data, signature)
+
+	thisPt.lock.Lock()
+	thisPt.rules = rules
+	thisPt.lock.Unlock()
+	thisPt.etag = resp.Header.Get("ETag")
+	return true, nil
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CHttpRuleRepository) poll(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-thisPt.stop:
+			return
+		case <-ticker.C:
+			changed, err := thisPt.refresh()
+			if err != nil {
+				log.Printf("can not fetch the rules from %s, %v \n", thisPt.url, err)
+				continue
+			}
+			if changed {
+				select {
+				case thisPt.changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//the channel is notified when new rules are fetched
+func (thisPt *CHttpRuleRepository) Changes() <-chan struct{} {
+	return thisPt.changes
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CHttpRuleRepository) Close() {
+	thisPt.stopOnce.Do(func() { close(thisPt.stop) })
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetSnapshot
+//the rules of the last verified fetch, the fetches replace the snapshot
+func (thisPt *CHttpRuleRepository) GetSnapshot() *CJsonRuleRepository {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+	return thisPt.rules
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetRules
+func (thisPt *CHttpRuleRepository) GetRules() []SRule {
+	return thisPt.GetSnapshot().Rules
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetGroups
+func (thisPt *CHttpRuleRepository) GetGroups() []SGroup {
+	return thisPt.GetSnapshot().Groups
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetExemptNetworks
+func (thisPt *CHttpRuleRepository) GetExemptNetworks() []string {
+	return thisPt.GetSnapshot().Exempt
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetPools
+func (thisPt *CHttpRuleRepository) GetPools() []SPool {
+	return thisPt.GetSnapshot().Pools
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.Reload
+func (thisPt *CHttpRuleRepository) Reload() error {
+	_, err := thisPt.refresh()
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+//fetch the rules and poll the server every interval. the cached copy is loaded if the server is not reachable.
+//publicKey is base64 encoded
+func CreateHttpRuleRepository(url string, publicKey string, cacheFile string, interval time.Duration) (*CHttpRuleRepository, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid rules public key")
+	}
+
+	ruleRep := new(CHttpRuleRepository)
+	ruleRep.url = url
+	ruleRep.publicKey = ed25519.PublicKey(key)
+	ruleRep.cacheFile = cacheFile
+	ruleRep.client = &http.Client{Timeout: HttpRulesTimeout}
+	ruleRep.changes = make(chan struct{}, 1)
+	ruleRep.stop = make(chan struct{})
+
+	if _, err := ruleRep.refresh(); err != nil {
+		log.Printf("can not fetch the rules from %s, the cached rules are used, %v \n", url, err)
+		if cacheErr := ruleRep.loadCache(); cacheErr != nil {
+			return nil, fmt.Errorf("%v, %v", err, cacheErr)
+		}
+	}
+
+	if interval > 0 {
+		go ruleRep.poll(interval)
+	}
+	return ruleRep, nil
+}
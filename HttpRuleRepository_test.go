@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//rules server with ETag support
+type cFakeRulesServer struct {
+	lock      sync.Mutex
+	key       ed25519.PrivateKey
+	rules     []byte
+	signature []byte
+	version   int
+	requests  int32
+	modified  int32
+}
+
+func (thisPt *cFakeRulesServer) setRules(rules string, signed bool) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	thisPt.rules = []byte(rules)
+	thisPt.signature = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(thisPt.key, thisPt.rules)))
+	if !signed {
+		thisPt.signature = []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(thisPt.key, []byte("other"))))
+	}
+	thisPt.version++
+}
+
+func (thisPt *cFakeRulesServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	atomic.AddInt32(&thisPt.requests, 1)
+
+	if req.URL.Path == "/rules.json.sig" {
+		w.Write(thisPt.signature)
+		return
+	}
+	etag := fmt.Sprintf(`"v%d"`, thisPt.version)
+	if req.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	atomic.AddInt32(&thisPt.modified, 1)
+	w.Header().Set("ETag", etag)
+	w.Write(thisPt.rules)
+}
+
+func TestHttpRuleRepository(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := base64.StdEncoding.EncodeToString(public)
+	rulesServer := &cFakeRulesServer{key: private}
+	rulesServer.setRules(`{"rules":[{"name":"first","destination":"10.0.0.0/8","protocol":"any"}]}`, true)
+	server := httptest.NewServer(rulesServer)
+	url := server.URL + "/rules.json"
+	cacheFile := filepath.Join(t.TempDir(), "rules.json")
+
+	repos, err := CreateHttpRuleRepository(url, publicKey, cacheFile, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repos.Close()
+	if len(repos.GetRules()) != 1 || repos.GetRules()[0].Name != "first" || repos.GetRules()[0].Origin != url {
+		t.Fatal("rules are not fetched")
+	}
+
+	//not modified rules are not downloaded again
+	time.Sleep(200 * time.Millisecond)
+	if atomic.LoadInt32(&rulesServer.modified) != 1 || atomic.LoadInt32(&rulesServer.requests) < 4 {
+		t.Fatal("rules should be polled with the etag")
+	}
+
+	//new rules are reported
+	rulesServer.setRules(`{"rules":[{"name":"second","destination":"10.0.0.0/8","protocol":"any"}]}`, true)
+	select {
+	case <-repos.Changes():
+	case <-time.After(5 * time.Second):
+		t.Fatal("change is not reported")
+	}
+	if repos.GetRules()[0].Name != "second" {
+		t.Fatal("new rules are not loaded")
+	}
+
+	//the rules with invalid signature are rejected
+	rulesServer.setRules(`{"rules":[{"name":"forged","destination":"10.0.0.0/8","protocol":"any"}]}`, false)
+	if err := repos.Reload(); err == nil || repos.GetRules()[0].Name != "second" {
+		t.Fatal("invalid signature should be rejected")
+	}
+	if _, err := CreateHttpRuleRepository(url, base64.StdEncoding.EncodeToString(public[:16]), "", 0); err == nil {
+		t.Fatal("invalid public key should be rejected")
+	}
+
+	//the cached rules are used when the server is down
+	server.Close()
+	cached, err := CreateHttpRuleRepository(url, publicKey, cacheFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached.GetRules()[0].Name != "second" || cached.GetRules()[0].Origin != url {
+		t.Fatal("cached rules are not loaded")
+	}
+	if err := cached.Reload(); err == nil {
+		t.Fatal("unreachable server should be reported")
+	}
+
+	//the cache is verified too
+	if err := ioutil.WriteFile(cacheFile, []byte(`{"rules":[]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateHttpRuleRepository(url, publicKey, cacheFile, 0); err == nil {
+		t.Fatal("tampered cache should be rejected")
+	}
+}
@@ -155,6 +155,39 @@ func (thisPt *cIPTrie) Search(ip net.IP) interface{} {
 
 //---------------------------------------------------------------------------------------
 
+//SearchAll . return the values of all the matched prefixes, the longest prefix first
+func (thisPt *cIPTrie) SearchAll(ip net.IP) []interface{} {
+	var i uint32
+	out := []interface{}{}
+	mask := uint32(32)
+	if thisPt.ipVersion == 6 {
+		mask = 128
+	}
+
+	if thisPt.root.Value != nil {
+		out = append(out, thisPt.root.Value)
+	}
+
+	activeNode := &thisPt.root
+	for i = 0; i < mask; i++ {
+		activeNode = activeNode.nodes[thisPt.getIPBit(ip, i)]
+		if activeNode == nil {
+			break
+		}
+		if activeNode.Value != nil {
+			out = append(out, activeNode.Value)
+		}
+	}
+
+	//reverse the order
+	for l, r := 0, len(out)-1; l < r; l, r = l+1, r-1 {
+		out[l], out[r] = out[r], out[l]
+	}
+	return out
+}
+
+//---------------------------------------------------------------------------------------
+
 func (thisPt *cIPTrie) SearchExact(ip net.IP, mask uint32) interface{} {
 	node := thisPt.findNode(ip, mask-1)
 	if node == nil {
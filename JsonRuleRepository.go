@@ -1,46 +1,112 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
-	"io/ioutil"
-	"log"
-	"os"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
 )
 
 //---------------------------------------------------------------------------------------
 type SRuleList []SRule
 
+//the included files are globs, relative to the directory of the file. files has the absolute names of the loaded
+//files and the include globs, they are watched for the changes
 type CJsonRuleRepository struct {
-	Rules SRuleList `json:"rules"`
+	Rules   SRuleList `json:"rules"`
+	Groups  []SGroup  `json:"groups"`
+	Exempt  []string  `json:"exempt_networks"`
+	Pools   []SPool   `json:"pools"`
+	Include []string  `json:"include"`
+	files   []string
 }
 
 func (thisPt *CJsonRuleRepository) loadRulesFromString(rules string) error {
+	//the unknown fields are rejected. the rules file could be the settings file, so the settings are accepted too
 	tempObj := CJsonRuleRepository{}
-	if err := json.Unmarshal([]byte(rules), &tempObj); err != nil {
+	errs, err := decodeConfigStrict([]byte(rules), &tempObj)
+	if err != nil {
 		return err
 	}
+	if len(errs) > 0 {
+		return errs
+	}
 	thisPt.Rules = tempObj.Rules
+	thisPt.Groups = tempObj.Groups
+	thisPt.Exempt = tempObj.Exempt
+	thisPt.Pools = tempObj.Pools
+	thisPt.Include = tempObj.Include
 	return nil
 }
 
 //---------------------------------------------------------------------------------------
-func (thisPt *CJsonRuleRepository) loadRules(fileName string) error {
-	stat, err := os.Stat(fileName)
+//load the file and its included files. the file is merged first, then the included files in their order, so the
+//included files override the rules, groups and pools of the file. parents has the files being loaded, to detect
+//the cycles
+func loadRuleFiles(fileName string, parents map[string]bool) (*CJsonRuleRepository, error) {
+	absName, err := filepath.Abs(fileName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if stat.Size() > MAX_FILE_SIZE {
-		return errors.New("invalid rule file size")
+	if parents[absName] {
+		return nil, fmt.Errorf("include cycle detected at %s", fileName)
 	}
+	parents[absName] = true
+	defer delete(parents, absName)
 
-	buf, err := ioutil.ReadFile(fileName)
+	buf, err := readConfigFile(fileName)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	file := new(CJsonRuleRepository)
+	if err := file.loadRulesFromString(string(buf)); err != nil {
+		return nil, err
+	}
+	for i := range file.Rules {
+		file.Rules[i].Origin = fileName
+	}
+	file.files = []string{absName}
+	if len(file.Include) == 0 {
+		return file, nil
 	}
 
-	return thisPt.loadRulesFromString(string(buf))
+	children := []IRuleRepository{file}
+	files := file.files
+	for _, pattern := range file.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(fileName), pattern)
+		}
+		if absPattern, err := filepath.Abs(pattern); err == nil {
+			files = append(files, absPattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid include %s in %s, %v", pattern, fileName, err)
+		}
+		//a pattern could match nothing, a file name should exist
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("included file %s of %s does not exist", pattern, fileName)
+		}
+		for _, match := range matches {
+			child, err := loadRuleFiles(match, parents)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", match, err)
+			}
+			children = append(children, child)
+			files = append(files, child.files...)
+		}
+	}
+
+	merged := mergeRuleRepositories(children)
+	merged.Include = file.Include
+	merged.files = files
+	return merged, nil
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetSnapshot
+func (thisPt *CJsonRuleRepository) GetSnapshot() *CJsonRuleRepository {
+	return thisPt
 }
 
 //---------------------------------------------------------------------------------------
@@ -50,20 +116,109 @@ func (thisPt *CJsonRuleRepository) GetRules() []SRule {
 }
 
 //---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetGroups
+func (thisPt *CJsonRuleRepository) GetGroups() []SGroup {
+	return thisPt.Groups
+}
 
-func CreateJsonRuleRepository(fileName string) IRuleRepository {
-	ruleRep := new(CJsonRuleRepository)
-	if err := ruleRep.loadRules(fileName); err != nil {
-		log.Fatalln(err)
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetExemptNetworks
+func (thisPt *CJsonRuleRepository) GetExemptNetworks() []string {
+	return thisPt.Exempt
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetPools
+func (thisPt *CJsonRuleRepository) GetPools() []SPool {
+	return thisPt.Pools
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.Reload
+//the repositories created from a string do not have any file
+func (thisPt *CJsonRuleRepository) Reload() error {
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+//rules repository of a rules file and its included files. every load replaces the snapshot, the loaded rules are
+//never changed
+type CJsonFileRuleRepository struct {
+	fileName string
+	lock     sync.RWMutex
+	rules    *CJsonRuleRepository
+}
+
+//---------------------------------------------------------------------------------------
+//the yaml and toml files are accepted too
+func (thisPt *CJsonFileRuleRepository) loadRules() error {
+	rules, err := loadRuleFiles(thisPt.fileName, map[string]bool{})
+	if err != nil {
+		return err
+	}
+
+	thisPt.lock.Lock()
+	thisPt.rules = rules
+	thisPt.lock.Unlock()
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetSnapshot
+func (thisPt *CJsonFileRuleRepository) GetSnapshot() *CJsonRuleRepository {
+	thisPt.lock.RLock()
+	defer thisPt.lock.RUnlock()
+	return thisPt.rules
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetRules
+func (thisPt *CJsonFileRuleRepository) GetRules() []SRule {
+	return thisPt.GetSnapshot().Rules
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetGroups
+func (thisPt *CJsonFileRuleRepository) GetGroups() []SGroup {
+	return thisPt.GetSnapshot().Groups
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetExemptNetworks
+func (thisPt *CJsonFileRuleRepository) GetExemptNetworks() []string {
+	return thisPt.GetSnapshot().Exempt
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.GetPools
+func (thisPt *CJsonFileRuleRepository) GetPools() []SPool {
+	return thisPt.GetSnapshot().Pools
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleRepository.Reload
+func (thisPt *CJsonFileRuleRepository) Reload() error {
+	return thisPt.loadRules()
+}
+
+//---------------------------------------------------------------------------------------
+func CreateJsonRuleRepository(fileName string) (IRuleRepository, error) {
+	ruleRep := new(CJsonFileRuleRepository)
+	ruleRep.fileName = fileName
+	if err := ruleRep.loadRules(); err != nil {
+		return nil, err
 	}
-	return ruleRep
+	return ruleRep, nil
 }
 
 //---------------------------------------------------------------------------------------
-func CreateJsonRuleRepositoryFromStr(data string) IRuleRepository {
+func CreateJsonRuleRepositoryFromStr(data string) (IRuleRepository, error) {
 	ruleRep := new(CJsonRuleRepository)
 	if err := ruleRep.loadRulesFromString(data); err != nil {
-		log.Fatalln(err)
+		return nil, err
+	}
+	if len(ruleRep.Include) > 0 {
+		return nil, newRuleError("", "include", "the files could be included just by the rules files")
 	}
-	return ruleRep
+	return ruleRep, nil
 }
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestRuleRep(t *testing.T) {
-	ruleRep := CreateJsonRuleRepository("data/setting.json")
-	if ruleRep == nil {
-		t.Fatalf("can not load rules")
+	ruleRep, err := CreateJsonRuleRepository("settings/setting.json")
+	if err != nil {
+		t.Fatalf("can not load rules, %v", err)
 	}
 
 	if len(ruleRep.GetRules()) < 1 {
@@ -15,3 +20,80 @@ func TestRuleRep(t *testing.T) {
 	}
 
 }
+
+func TestRuleRepErrors(t *testing.T) {
+	if _, err := CreateJsonRuleRepository("settings/unknown.json"); err == nil {
+		t.Fatal("missing file should be rejected")
+	}
+	if _, err := CreateJsonRuleRepositoryFromStr(`{"rules":`); err == nil {
+		t.Fatal("invalid json should be rejected")
+	}
+}
+
+func TestRuleRepIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, data string) string {
+		fileName := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+
+	//the later files override the rules with the same names, the pools could be defined by any file
+	rulesFile := writeFile("rules.json", `{"include":["customers/*.json","common.yaml"],"rules":[{"name":"web","destination":"10.1.0.0/16","protocol":"any","pool":"family"}]}`)
+	writeFile("customers/a.json", `{"rules":[{"name":"web","destination":"10.2.0.0/16","protocol":"any","pool":"family"}],"exempt_networks":["10.9.0.0/16"]}`)
+	writeFile("customers/b.json", `{"rules":[{"name":"mail","destination":"10.3.0.0/16","protocol":"any"}],"exempt_networks":["10.9.0.0/16"]}`)
+	common := writeFile("common.yaml", "pools:\n  - name: family\n    size: 10gb\n")
+
+	ruleRep, err := CreateJsonRuleRepository(rulesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := ruleRep.GetRules()
+	if len(rules) != 2 || rules[0].Name != "web" || rules[0].Destination != "10.2.0.0/16" || rules[1].Name != "mail" {
+		t.Fatalf("invalid rules %+v", rules)
+	}
+	if rules[0].Origin != filepath.Join(dir, "customers/a.json") || len(ruleRep.GetPools()) != 1 || len(ruleRep.GetExemptNetworks()) != 1 {
+		t.Fatalf("invalid merged rules %+v", ruleRep)
+	}
+	matcher, err := CreateMatcher(ruleRep, nil, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher.Close()
+	if _, err := LoadSettings(rulesFile); err != nil {
+		t.Fatal(err)
+	}
+
+	//the duplicates report the files of both rules
+	writeFile("customers/c.json", `{"rules":[{"name":"other","destination":"10.3.0.0/16","protocol":"any"}]}`)
+	if err := ruleRep.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = CreateMatcher(ruleRep, nil, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil)
+	ruleErr := new(SRuleError)
+	if !errors.As(err, &ruleErr) || ruleErr.Origin != filepath.Join(dir, "customers/c.json") || !strings.Contains(ruleErr.Reason, filepath.Join(dir, "customers/b.json")) {
+		t.Fatalf("invalid error %v", err)
+	}
+
+	//the missing files and the cycles are rejected
+	if err := ioutil.WriteFile(common, []byte(`{"include":["missing.json"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ruleRep.Reload(); err == nil {
+		t.Fatal("missing file should be rejected")
+	}
+	if err := ioutil.WriteFile(common, []byte(`{"include":["rules.json"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ruleRep.Reload(); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("cycle should be rejected, %v", err)
+	}
+	if _, err := CreateJsonRuleRepositoryFromStr(`{"include":["x.json"]}`); err == nil {
+		t.Fatal("include should be rejected without file")
+	}
+}
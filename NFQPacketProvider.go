@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log"
+	"net"
 	"os/exec"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/Telefonica/nfqueue"
+	"github.com/florianl/go-nfqueue"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
@@ -15,35 +20,38 @@ import (
 type SNFQStatus struct {
 	Totalpackets uint64 `json:"total_packets"`
 	Blocked      uint64 `json:"blocked"`
+	Rejected     uint64 `json:"rejected"`
+	Marked       uint64 `json:"marked"`
+	Delayed      uint64 `json:"delayed"`
 }
 
 //---------------------------------------------------------------------------------------
 //tun packet provider implement IPacketProvider
 type CNFQPacketProvider struct {
-	queue          *nfqueue.Queue
+	queue          *nfqueue.Nfqueue
+	cancel         context.CancelFunc
 	matcher        IRuleMatcher
 	queueNum       uint16
 	gwMode         bool
 	runIPTCommands bool
 	stat           SNFQStatus
+	rawSender      cRawSender
+	delayLock      sync.Mutex
+	delayed        map[uint32]*time.Timer
 }
 
 //---------------------------------------------------------------------------------------
-func (thisPt *CNFQPacketProvider) execCommand(command string) error {
+func (thisPt *CNFQPacketProvider) execCommand(tool string, command string) error {
 	//double space will cause  problem
 	strList := strings.Split(strings.ReplaceAll(command, "  ", " "), " ")
-	if _, err := exec.Command("iptables", strList...).Output(); err != nil {
+	if _, err := exec.Command(tool, strList...).Output(); err != nil {
 		return err
 	}
 	return nil
 }
 
 //---------------------------------------------------------------------------------------
-func (thisPt *CNFQPacketProvider) setIpTablesRule(add bool) error {
-
-	if !thisPt.runIPTCommands {
-		return nil
-	}
+func (thisPt *CNFQPacketProvider) setTableRule(tool string, add bool) error {
 
 	op := "-A"
 	if !add {
@@ -51,14 +59,35 @@ func (thisPt *CNFQPacketProvider) setIpTablesRule(add bool) error {
 	}
 
 	if thisPt.gwMode {
-		return thisPt.execCommand(fmt.Sprintf("%s FORWARD -j NFQUEUE --queue-num %d", op, thisPt.queueNum))
+		return thisPt.execCommand(tool, fmt.Sprintf("%s FORWARD -j NFQUEUE --queue-num %d", op, thisPt.queueNum))
+	}
+
+	//the reject answers are sent with RejectPacketMark and are not queued, the answers of the local packets come
+	//back through INPUT
+	skipAnswers := fmt.Sprintf("-m mark ! --mark %#x/%#x", RejectPacketMark, RejectPacketMark)
+	if err := thisPt.execCommand(tool, fmt.Sprintf("%s INPUT %s -j NFQUEUE --queue-num %d", op, skipAnswers, thisPt.queueNum)); err != nil {
+		return err
+	}
+
+	return thisPt.execCommand(tool, fmt.Sprintf("%s OUTPUT %s -j NFQUEUE --queue-num %d", op, skipAnswers, thisPt.queueNum))
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CNFQPacketProvider) setIpTablesRule(add bool) error {
+
+	if !thisPt.runIPTCommands {
+		return nil
 	}
 
-	if err := thisPt.execCommand(fmt.Sprintf("%s INPUT -j NFQUEUE --queue-num %d", op, thisPt.queueNum)); err != nil {
+	if err := thisPt.setTableRule("iptables", add); err != nil {
 		return err
 	}
 
-	return thisPt.execCommand(fmt.Sprintf("%s OUTPUT -j NFQUEUE --queue-num %d", op, thisPt.queueNum))
+	//IPv6 is optional, the host may not have ip6tables
+	if err := thisPt.setTableRule("ip6tables", add); err != nil && add {
+		log.Printf("can not set ip6tables rules, IPv6 traffic is not filtered. %v \n", err)
+	}
+	return nil
 }
 
 //---------------------------------------------------------------------------------------
@@ -95,6 +124,56 @@ func (thisPt *CNFQPacketProvider) processPacket(data []byte) (bool, SPacket) {
 	return true, out
 }
 
+//---------------------------------------------------------------------------------------
+func (thisPt *CNFQPacketProvider) setVerdict(id uint32, verdict int) {
+	if err := thisPt.queue.SetVerdict(id, verdict); err != nil {
+		log.Printf("can not set the verdict of packet %d, %v \n", id, err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//accept the packet, the marked packets are accepted with their new mark
+func (thisPt *CNFQPacketProvider) acceptPacket(id uint32, verdict SVerdict) {
+	if verdict.Result != PacketProcessResultMark {
+		thisPt.setVerdict(id, nfqueue.NfAccept)
+		return
+	}
+	if err := thisPt.queue.SetVerdictWithMark(id, nfqueue.NfAccept, int(verdict.Mark)); err != nil {
+		log.Printf("can not set the verdict of packet %d, %v \n", id, err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//hold the packet without blocking the queue, the verdict is set when the delay is over
+func (thisPt *CNFQPacketProvider) delayPacket(id uint32, verdict SVerdict) {
+	thisPt.delayLock.Lock()
+	defer thisPt.delayLock.Unlock()
+	thisPt.delayed[id] = time.AfterFunc(verdict.Delay, func() { thisPt.releasePacket(id, verdict) })
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CNFQPacketProvider) releasePacket(id uint32, verdict SVerdict) {
+	thisPt.delayLock.Lock()
+	defer thisPt.delayLock.Unlock()
+	if _, fnd := thisPt.delayed[id]; !fnd {
+		return
+	}
+	delete(thisPt.delayed, id)
+	thisPt.acceptPacket(id, verdict)
+}
+
+//---------------------------------------------------------------------------------------
+//accept all the delayed packets, the verdicts can not be set after the queue is closed
+func (thisPt *CNFQPacketProvider) releaseDelayedPackets() {
+	thisPt.delayLock.Lock()
+	defer thisPt.delayLock.Unlock()
+	for id, timer := range thisPt.delayed {
+		timer.Stop()
+		thisPt.setVerdict(id, nfqueue.NfAccept)
+	}
+	thisPt.delayed = map[uint32]*time.Timer{}
+}
+
 //---------------------------------------------------------------------------------------
 // implement  IPacketProvider.Start
 func (thisPt *CNFQPacketProvider) Start() error {
@@ -103,8 +182,35 @@ func (thisPt *CNFQPacketProvider) Start() error {
 	if err := thisPt.setIpTablesRule(true); err != nil {
 		return err
 	}
-	go thisPt.queue.Start()
-	time.Sleep(100 * time.Millisecond)
+
+	queueCfg := &nfqueue.Config{
+		NfQueue:      thisPt.queueNum,
+		MaxQueueLen:  2048,
+		MaxPacketLen: 0xffff,
+		Copymode:     nfqueue.NfQnlCopyPacket,
+		Flags:        nfqueue.NfQaCfgFlagFailOpen,
+		AfFamily:     syscall.AF_INET,
+		WriteTimeout: 100 * time.Millisecond,
+	}
+
+	queue, err := nfqueue.Open(queueCfg)
+	if err != nil {
+		thisPt.setIpTablesRule(false)
+		return err
+	}
+	if err := queue.Con.SetReadBuffer(1600000); err != nil {
+		log.Printf("can not set the queue buffer size, %v \n", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := queue.RegisterWithErrorFunc(ctx, thisPt.Handle, thisPt.handleError); err != nil {
+		cancel()
+		queue.Close()
+		thisPt.setIpTablesRule(false)
+		return err
+	}
+	thisPt.queue = queue
+	thisPt.cancel = cancel
 	return nil
 }
 
@@ -114,23 +220,78 @@ func (thisPt *CNFQPacketProvider) Stop() error {
 	if err := thisPt.setIpTablesRule(false); err != nil {
 		return err
 	}
-	return thisPt.queue.Stop()
+	thisPt.rawSender.Close()
+	if thisPt.queue == nil {
+		return nil
+	}
+	thisPt.releaseDelayedPackets()
+	thisPt.cancel()
+	err := thisPt.queue.Close()
+	thisPt.queue = nil
+	return err
+}
+
+//---------------------------------------------------------------------------------------
+//the receive errors are logged, the queue keeps running. ENOBUFS is reported when the kernel drops messages
+func (thisPt *CNFQPacketProvider) handleError(err error) int {
+	log.Printf("nfqueue receive error, %v \n", err)
+	return 0
 }
 
 //---------------------------------------------------------------------------------------
-// implement  nfqueue.PacketHandler
-func (thisPt *CNFQPacketProvider) Handle(p *nfqueue.Packet) {
+// implement  nfqueue.HookFunc
+func (thisPt *CNFQPacketProvider) Handle(a nfqueue.Attribute) int {
+
+	if a.PacketID == nil {
+		return 0
+	}
+	id := *a.PacketID
+	if a.Payload == nil || len(*a.Payload) == 0 {
+		thisPt.setVerdict(id, nfqueue.NfAccept)
+		return 0
+	}
+	data := *a.Payload
 
-	if res, packet := thisPt.processPacket(p.Buffer); res {
+	verdict := SVerdict{}
+	if res, packet := thisPt.processPacket(data); res {
+		//the packets of the OUTPUT hook have no hardware address
+		if a.HwAddr != nil {
+			packet.SrcMAC = append(net.HardwareAddr{}, *a.HwAddr...)
+		}
 		if thisPt.matcher != nil {
 			thisPt.stat.Totalpackets++
-			if res, _ := thisPt.matcher.Match(&packet, 0); res == PacketProcessResultDrop {
+			verdict = thisPt.matcher.Match(&packet, 0)
+			switch verdict.Result {
+			case PacketProcessResultDrop:
+				thisPt.stat.Blocked++
+				thisPt.setVerdict(id, nfqueue.NfDrop)
+				return 0
+			case PacketProcessResultReject:
+				//the rejected packets are always dropped. RST and ICMP errors are never answered
+				if answer, dst, ok := createRejectPacket(data); ok {
+					if err := thisPt.rawSender.Send(answer, dst); err != nil {
+						log.Printf("can not send reject packet, %v \n", err)
+					}
+				}
 				thisPt.stat.Blocked++
-				p.Drop()
+				thisPt.stat.Rejected++
+				thisPt.setVerdict(id, nfqueue.NfDrop)
+				return 0
+			case PacketProcessResultMark:
+				thisPt.stat.Marked++
+			}
+
+			//packets of the rate limit rules could be held until their tokens are available. the other packets
+			//of the queue are not blocked
+			if verdict.Delay > 0 {
+				thisPt.stat.Delayed++
+				thisPt.delayPacket(id, verdict)
+				return 0
 			}
 		}
 	}
-	p.Accept()
+	thisPt.acceptPacket(id, verdict)
+	return 0
 }
 
 //---------------------------------------------------------------------------------------
@@ -145,18 +306,10 @@ func (thisPt *CNFQPacketProvider) Dump() string {
 func CreateNFQProvider(queueNum uint16, gwMode bool, runIPTCommands bool, matcher IRuleMatcher) IPacketProvider {
 
 	provider := new(CNFQPacketProvider)
-
-	queueCfg := &nfqueue.QueueConfig{
-		MaxPackets: 2048,
-		BufferSize: 1600000,
-		QueueFlags: []nfqueue.QueueFlag{nfqueue.FailOpen},
-	}
-
-	provider.queue = nfqueue.NewQueue(queueNum, provider, queueCfg)
-
 	provider.queueNum = queueNum
 	provider.gwMode = gwMode
 	provider.runIPTCommands = runIPTCommands
 	provider.matcher = matcher
+	provider.delayed = map[uint32]*time.Timer{}
 	return provider
 }
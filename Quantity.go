@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+//---------------------------------------------------------------------------------------
+//unit of a quantity. the units are sorted from the largest to the smallest, the first ones are used for formatting
+type sQuantityUnit struct {
+	Name   string
+	Factor int64
+}
+
+//size_units si, the byte units are SI and the units with i are IEC
+var siSizeUnits = []sQuantityUnit{
+	{"pb", 1e15}, {"tb", 1e12}, {"gb", 1e9}, {"mb", 1e6}, {"kb", 1e3}, {"b", 1},
+	{"pib", 1 << 50}, {"tib", 1 << 40}, {"gib", 1 << 30}, {"mib", 1 << 20}, {"kib", 1 << 10},
+}
+
+//size_units binary (default), the byte units without i are 1024 based too
+var binarySizeUnits = []sQuantityUnit{
+	{"pb", 1 << 50}, {"tb", 1 << 40}, {"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10}, {"b", 1},
+	{"pib", 1 << 50}, {"tib", 1 << 40}, {"gib", 1 << 30}, {"mib", 1 << 20}, {"kib", 1 << 10},
+}
+
+//the IEC units for formatting the SI sizes, the last one is the base unit
+var iecSizeUnits = []sQuantityUnit{
+	{"pib", 1 << 50}, {"tib", 1 << 40}, {"gib", 1 << 30}, {"mib", 1 << 20}, {"kib", 1 << 10}, {"b", 1},
+}
+
+//the rates are SI, the units with i are IEC
+var rateUnits = []sQuantityUnit{
+	{"tbit", 1e12}, {"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+	{"tibit", 1 << 40}, {"gibit", 1 << 30}, {"mibit", 1 << 20}, {"kibit", 1 << 10},
+}
+
+var durationUnits = []sQuantityUnit{
+	{"w", 7 * 24 * 3600}, {"d", 24 * 3600}, {"h", 3600}, {"m", 60}, {"s", 1},
+}
+
+//longer values are rejected, the quantities are short
+const MaxQuantityLength = 64
+
+//---------------------------------------------------------------------------------------
+func findQuantityUnit(name string, units []sQuantityUnit) (sQuantityUnit, bool) {
+	for _, unit := range units {
+		if unit.Name == name {
+			return unit, true
+		}
+	}
+	return sQuantityUnit{}, false
+}
+
+//---------------------------------------------------------------------------------------
+//parse a quantity like 1.5gb. compound quantities like 1h30m are the sum of their parts, each unit could be
+//used once. the result is rounded to the nearest integer
+func parseQuantity(item string, units []sQuantityUnit, compound bool) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(item))
+	if len(value) == 0 {
+		return 0, errors.New("empty value")
+	}
+	if len(value) > MaxQuantityLength {
+		return 0, fmt.Errorf("invalid value %s", item)
+	}
+
+	total := new(big.Rat)
+	used := map[string]bool{}
+	for len(value) > 0 {
+		//number, digits with an optional fraction
+		i := 0
+		dots := 0
+		for i < len(value) && (value[i] >= '0' && value[i] <= '9' || value[i] == '.') {
+			if value[i] == '.' {
+				dots++
+			}
+			i++
+		}
+		number := value[:i]
+		if len(strings.Trim(number, ".")) == 0 || dots > 1 {
+			return 0, fmt.Errorf("invalid number in %s", item)
+		}
+		value = strings.TrimLeft(value[i:], " ")
+
+		//unit
+		i = 0
+		for i < len(value) && value[i] >= 'a' && value[i] <= 'z' {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("missing unit in %s", item)
+		}
+		unit, fnd := findQuantityUnit(value[:i], units)
+		if !fnd {
+			return 0, fmt.Errorf("invalid unit %s in %s", value[:i], item)
+		}
+		if used[unit.Name] {
+			return 0, fmt.Errorf("duplicate unit %s in %s", unit.Name, item)
+		}
+		used[unit.Name] = true
+		value = strings.TrimLeft(value[i:], " ")
+
+		part, ok := new(big.Rat).SetString(number)
+		if !ok {
+			return 0, fmt.Errorf("invalid number in %s", item)
+		}
+		total.Add(total, part.Mul(part, new(big.Rat).SetInt64(unit.Factor)))
+
+		if !compound && len(value) > 0 {
+			return 0, fmt.Errorf("invalid value %s", item)
+		}
+	}
+
+	//round half up
+	rounded := new(big.Int).Quo(new(big.Int).Add(new(big.Int).Mul(total.Num(), big.NewInt(2)), total.Denom()), new(big.Int).Mul(total.Denom(), big.NewInt(2)))
+	if !rounded.IsInt64() {
+		return 0, fmt.Errorf("value %s is too large", item)
+	}
+	return rounded.Int64(), nil
+}
+
+//---------------------------------------------------------------------------------------
+//format the value with the largest unit that keeps it exact, the fractions are used if they are exact too
+func formatQuantity(value int64, units []sQuantityUnit) string {
+	for _, unit := range units {
+		if value < unit.Factor && unit.Factor > 1 {
+			continue
+		}
+		if value%unit.Factor == 0 {
+			return strconv.FormatInt(value/unit.Factor, 10) + unit.Name
+		}
+		text := strconv.FormatFloat(float64(value)/float64(unit.Factor), 'f', -1, 64)
+		if parsed, err := parseQuantity(text+unit.Name, units, false); err == nil && parsed == value && len(text) <= 8 {
+			return text + unit.Name
+		}
+	}
+	//the last unit is the base unit
+	return strconv.FormatInt(value, 10) + units[len(units)-1].Name
+}
+
+//---------------------------------------------------------------------------------------
+//return the size units of SizeUnitsBinary or SizeUnitsSI
+func getSizeUnits(units int) []sQuantityUnit {
+	if units == SizeUnitsSI {
+		return siSizeUnits
+	}
+	return binarySizeUnits
+}
+
+//---------------------------------------------------------------------------------------
+//convert a data size like 1.5gb or 100MiB to bytes, units is SizeUnitsBinary or SizeUnitsSI
+func parseSize(item string, units int) (int64, error) {
+	return parseQuantity(item, getSizeUnits(units), false)
+}
+
+//---------------------------------------------------------------------------------------
+//convert a rate like 2mbit to bits per second
+func parseRate(item string) (int64, error) {
+	return parseQuantity(item, rateUnits, false)
+}
+
+//---------------------------------------------------------------------------------------
+//convert a duration like 1h30m or 2d to seconds
+func parseDuration(item string) (int64, error) {
+	return parseQuantity(item, durationUnits, true)
+}
+
+//---------------------------------------------------------------------------------------
+func formatSize(size int64, units int) string {
+	text := formatQuantity(size, getSizeUnits(units)[:6])
+	//the IEC units are used if they are shorter, for example 2kib instead of 2.048kb
+	if units == SizeUnitsSI {
+		if iec := formatQuantity(size, iecSizeUnits); len(iec) < len(text) {
+			text = iec
+		}
+	}
+	return text
+}
+
+//---------------------------------------------------------------------------------------
+func formatRate(rate int64) string {
+	return formatQuantity(rate, rateUnits[:5])
+}
+
+//---------------------------------------------------------------------------------------
+//format the duration as its parts, for example 1h30m
+func formatDuration(seconds int64) string {
+	if seconds <= 0 {
+		return strconv.FormatInt(seconds, 10) + "s"
+	}
+	parts := []string{}
+	for _, unit := range durationUnits {
+		if seconds >= unit.Factor {
+			parts = append(parts, strconv.FormatInt(seconds/unit.Factor, 10)+unit.Name)
+			seconds %= unit.Factor
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+//---------------------------------------------------------------------------------------
+//the limits are -1 if they are not defined
+func formatLimit(value int64, format func(int64) string) string {
+	if value < 0 {
+		return ""
+	}
+	return format(value)
+}
@@ -0,0 +1,34 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"testing"
+)
+
+//the parsed quantities should not panic and should survive the round trip
+func FuzzParseQuantity(f *testing.F) {
+	for _, item := range []string{"1.5gb", "100MiB", "2mbit", "1h30m", "2d", "10", ".5kb", "1w 2d 3h"} {
+		f.Add(item)
+	}
+	f.Fuzz(func(t *testing.T, item string) {
+		for _, units := range []int{SizeUnitsBinary, SizeUnitsSI} {
+			if value, err := parseSize(item, units); err == nil {
+				if parsed, err := parseSize(formatSize(value, units), units); err != nil || parsed != value {
+					t.Fatalf("invalid size round trip of %s", item)
+				}
+			}
+		}
+		if value, err := parseRate(item); err == nil {
+			if parsed, err := parseRate(formatRate(value)); err != nil || parsed != value {
+				t.Fatalf("invalid rate round trip of %s", item)
+			}
+		}
+		if value, err := parseDuration(item); err == nil {
+			if parsed, err := parseDuration(formatDuration(value)); err != nil || parsed != value {
+				t.Fatalf("invalid duration round trip of %s", item)
+			}
+		}
+	})
+}
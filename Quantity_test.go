@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+)
+
+//the SI size units are opt-in
+func parseSISize(item string) (int64, error) {
+	return parseSize(item, SizeUnitsSI)
+}
+
+func formatSISize(size int64) string {
+	return formatSize(size, SizeUnitsSI)
+}
+
+func TestParseQuantity(t *testing.T) {
+	for _, item := range []struct {
+		text  string
+		parse func(string) (int64, error)
+		value int64
+		valid bool
+	}{
+		{"500b", parseSISize, 500, true},
+		{"2kb", parseSISize, 2000, true},
+		{"1.5gb", parseSISize, 15e8, true},
+		{"1tb", parseSISize, 1e12, true},
+		{"100MiB", parseSISize, 100 << 20, true},
+		{"1.5 GiB", parseSISize, 3 << 29, true},
+		{".5kb", parseSISize, 500, true},
+		{"0.1kib", parseSISize, 102, true},
+		{"0.0001b", parseSISize, 0, true},
+		{"10", parseSISize, 0, false},
+		{"kb", parseSISize, 0, false},
+		{"1.2.3kb", parseSISize, 0, false},
+		{"1xb", parseSISize, 0, false},
+		{"1kb2b", parseSISize, 0, false},
+		{"-1kb", parseSISize, 0, false},
+		{"", parseSISize, 0, false},
+		{"9999999999pb", parseSISize, 0, false},
+		{"256kbit", parseRate, 256000, true},
+		{"2.5mbit", parseRate, 2500000, true},
+		{"1kibit", parseRate, 1024, true},
+		{"1tbit", parseRate, 1e12, true},
+		{"1mb", parseRate, 0, false},
+		{"10s", parseDuration, 10, true},
+		{"1h30m", parseDuration, 5400, true},
+		{"1h 30m", parseDuration, 5400, true},
+		{"2d", parseDuration, 2 * 86400, true},
+		{"1w2d", parseDuration, 9 * 86400, true},
+		{"1.5h", parseDuration, 5400, true},
+		{"30m1h", parseDuration, 5400, true},
+		{"1h1h", parseDuration, 0, false},
+		{"1h30", parseDuration, 0, false},
+		{"1y", parseDuration, 0, false},
+	} {
+		value, err := item.parse(item.text)
+		if (err == nil) != item.valid || value != item.value {
+			t.Fatalf("invalid value %d of %s, %v", value, item.text, err)
+		}
+	}
+}
+
+func TestFormatQuantity(t *testing.T) {
+	for _, item := range []struct {
+		value  int64
+		format func(int64) string
+		parse  func(string) (int64, error)
+		text   string
+	}{
+		{0, formatSISize, parseSISize, "0b"},
+		{500, formatSISize, parseSISize, "500b"},
+		{2000, formatSISize, parseSISize, "2kb"},
+		{2048, formatSISize, parseSISize, "2kib"},
+		{15e8, formatSISize, parseSISize, "1.5gb"},
+		{3 << 29, formatSISize, parseSISize, "1.5gib"},
+		{1e12, formatSISize, parseSISize, "1tb"},
+		{1024000, formatSISize, parseSISize, "1.024mb"},
+		{1025, formatSISize, parseSISize, "1025b"},
+		{2500000, formatRate, parseRate, "2.5mbit"},
+		{1024, formatRate, parseRate, "1.024kbit"},
+		{0, formatDuration, parseDuration, "0s"},
+		{5400, formatDuration, parseDuration, "1h30m"},
+		{9*86400 + 61, formatDuration, parseDuration, "1w2d1m1s"},
+	} {
+		text := item.format(item.value)
+		if text != item.text {
+			t.Fatalf("invalid format %s of %d", text, item.value)
+		}
+		if value, err := item.parse(text); err != nil || value != item.value {
+			t.Fatalf("invalid round trip of %d", item.value)
+		}
+	}
+}
+
+func TestBinarySizeUnits(t *testing.T) {
+	for _, item := range []struct {
+		text  string
+		value int64
+	}{
+		{"2kb", 2048},
+		{"1.5gb", 3 << 29},
+		{"1tb", 1 << 40},
+		{"100MiB", 100 << 20},
+		{"500b", 500},
+	} {
+		if value, err := parseSize(item.text, SizeUnitsBinary); err != nil || value != item.value {
+			t.Fatalf("invalid value %d of %s, %v", value, item.text, err)
+		}
+	}
+	if text := formatSize(3<<29, SizeUnitsBinary); text != "1.5gb" {
+		t.Fatalf("invalid format %s", text)
+	}
+	if text := formatSize(2048, SizeUnitsBinary); text != "2kb" {
+		t.Fatalf("invalid format %s", text)
+	}
+}
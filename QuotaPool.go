@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+//---------------------------------------------------------------------------------------
+//status of a quota pool
+type SQuotaPoolStatus struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	TopUp     int64  `json:"top_up"`
+	Used      int64  `json:"used"`
+	Remaining int64  `json:"remaining"`
+}
+
+//---------------------------------------------------------------------------------------
+//data quota shared by the rules. the pools are kept by name when the rules are reloaded
+type sQuotaPool struct {
+	Name  string
+	Size  int64
+	TopUp int64
+	Used  int64
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *sQuotaPool) getLimit() int64 {
+	return atomic.LoadInt64(&thisPt.Size) + atomic.LoadInt64(&thisPt.TopUp)
+}
+
+//---------------------------------------------------------------------------------------
+//return true if the pool does not have any data
+func (thisPt *sQuotaPool) exhausted() bool {
+	return atomic.LoadInt64(&thisPt.Used) >= thisPt.getLimit()
+}
+
+//---------------------------------------------------------------------------------------
+//charge the data to the pool. returns false if the pool is exhausted, the packets of exhausted pools are not charged
+func (thisPt *sQuotaPool) charge(size int64) bool {
+	for {
+		used := atomic.LoadInt64(&thisPt.Used)
+		if used >= thisPt.getLimit() {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&thisPt.Used, used, used+size) {
+			return true
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//give back the charged data of a blocked packet
+func (thisPt *sQuotaPool) refund(size int64) {
+	atomic.AddInt64(&thisPt.Used, -size)
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *sQuotaPool) addTopUp(size int64) {
+	atomic.AddInt64(&thisPt.TopUp, size)
+}
+
+//---------------------------------------------------------------------------------------
+//clear the usage and the top ups of the pool
+func (thisPt *sQuotaPool) reset() {
+	atomic.StoreInt64(&thisPt.Used, 0)
+	atomic.StoreInt64(&thisPt.TopUp, 0)
+}
+
+//---------------------------------------------------------------------------------------
+//return the used percent of the pool
+func (thisPt *sQuotaPool) getPercent() int64 {
+	limit := thisPt.getLimit()
+	if limit <= 0 {
+		return 100
+	}
+	return atomic.LoadInt64(&thisPt.Used) * 100 / limit
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *sQuotaPool) getStatus() SQuotaPoolStatus {
+	status := SQuotaPoolStatus{Name: thisPt.Name}
+	status.Size = atomic.LoadInt64(&thisPt.Size)
+	status.TopUp = atomic.LoadInt64(&thisPt.TopUp)
+	status.Used = atomic.LoadInt64(&thisPt.Used)
+	status.Remaining = status.Size + status.TopUp - status.Used
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	}
+	return status
+}
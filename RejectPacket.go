@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+//maximum size of the original packet in the ICMPv6 errors (minimum IPv6 MTU - IPv6 and ICMPv6 headers)
+const ICMPv6MaxPayload = 1280 - 40 - 8
+
+//mark bit of the reject answers. the NFQUEUE rules skip the packets with this bit, so the answers are not queued
+const RejectPacketMark = 0x40000000
+
+//---------------------------------------------------------------------------------------
+//build the reject answer of a packet. TCP packets are answered with RST and the others with ICMP port
+//unreachable. returns false for the packets that should not be answered, like RST and ICMP errors
+func createRejectPacket(data []byte) ([]byte, net.IP, bool) {
+
+	layer := layers.LayerTypeIPv4
+	if (data[0] & 0xf0) == 0x60 {
+		layer = layers.LayerTypeIPv6
+	}
+
+	packet := gopacket.NewPacket(data, layer, gopacket.Default)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	//answer header
+	var ip gopacket.NetworkLayer
+	var dst net.IP
+	if ipv4, ok := packet.NetworkLayer().(*layers.IPv4); ok {
+		ip = &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: ipv4.DstIP, DstIP: ipv4.SrcIP}
+		dst = ipv4.SrcIP
+	} else if ipv6, ok := packet.NetworkLayer().(*layers.IPv6); ok {
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: ipv6.DstIP, DstIP: ipv6.SrcIP}
+		dst = ipv6.SrcIP
+	} else {
+		return nil, nil, false
+	}
+
+	//TCP reset
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		if tcp.RST {
+			return nil, nil, false
+		}
+
+		rst := &layers.TCP{SrcPort: tcp.DstPort, DstPort: tcp.SrcPort, RST: true}
+		if tcp.ACK {
+			rst.Seq = tcp.Ack
+		} else {
+			rst.ACK = true
+			rst.Ack = tcp.Seq + uint32(len(tcp.Payload))
+			if tcp.SYN {
+				rst.Ack++
+			}
+			if tcp.FIN {
+				rst.Ack++
+			}
+		}
+
+		if ipv4, ok := ip.(*layers.IPv4); ok {
+			ipv4.Protocol = layers.IPProtocolTCP
+			rst.SetNetworkLayerForChecksum(ipv4)
+			if err := gopacket.SerializeLayers(buf, opts, ipv4, rst); err != nil {
+				return nil, nil, false
+			}
+		} else {
+			ipv6 := ip.(*layers.IPv6)
+			ipv6.NextHeader = layers.IPProtocolTCP
+			rst.SetNetworkLayerForChecksum(ipv6)
+			if err := gopacket.SerializeLayers(buf, opts, ipv6, rst); err != nil {
+				return nil, nil, false
+			}
+		}
+		return buf.Bytes(), dst, true
+	}
+
+	//ICMP port unreachable. never answer the ICMP errors
+	if ipv4, ok := ip.(*layers.IPv4); ok {
+		if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+			switch icmp.TypeCode.Type() {
+			case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench, layers.ICMPv4TypeRedirect,
+				layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+				return nil, nil, false
+			}
+		}
+
+		//original IP header and 8 bytes of its payload
+		original := packet.NetworkLayer().(*layers.IPv4)
+		size := int(original.IHL)*4 + 8
+		if size > len(data) {
+			size = len(data)
+		}
+
+		icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)}
+		if err := gopacket.SerializeLayers(buf, opts, ipv4, icmp, gopacket.Payload(data[:size])); err != nil {
+			return nil, nil, false
+		}
+		return buf.Bytes(), dst, true
+	}
+
+	ipv6 := ip.(*layers.IPv6)
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok && icmp.TypeCode.Type() < 128 {
+		return nil, nil, false
+	}
+
+	//4 unused bytes and as much of the original packet as possible
+	size := len(data)
+	if size > ICMPv6MaxPayload {
+		size = ICMPv6MaxPayload
+	}
+	payload := append(make([]byte, 4), data[:size]...)
+
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodePortUnreachable)}
+	icmp.SetNetworkLayerForChecksum(ipv6)
+	if err := gopacket.SerializeLayers(buf, opts, ipv6, icmp, gopacket.Payload(payload)); err != nil {
+		return nil, nil, false
+	}
+	return buf.Bytes(), dst, true
+}
+
+//---------------------------------------------------------------------------------------
+//send the complete IP packets through the raw sockets
+type cRawSender struct {
+	lock sync.Mutex
+	fd4  int
+	fd6  int
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cRawSender) getSocket(ipVersion int) (int, error) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	fd := &thisPt.fd4
+	family := syscall.AF_INET
+	if ipVersion == 6 {
+		fd = &thisPt.fd6
+		family = syscall.AF_INET6
+	}
+
+	if *fd <= 0 {
+		//IPPROTO_RAW sockets include the IP header
+		sock, err := syscall.Socket(family, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+		if err != nil {
+			return 0, err
+		}
+		if err := syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, syscall.SO_MARK, RejectPacketMark); err != nil {
+			syscall.Close(sock)
+			return 0, err
+		}
+		*fd = sock
+	}
+	return *fd, nil
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cRawSender) Send(data []byte, dst net.IP) error {
+	if ip := dst.To4(); ip != nil {
+		fd, err := thisPt.getSocket(4)
+		if err != nil {
+			return err
+		}
+		addr := syscall.SockaddrInet4{}
+		copy(addr.Addr[:], ip)
+		return syscall.Sendto(fd, data, 0, &addr)
+	}
+
+	if len(dst) != net.IPv6len {
+		return errors.New("invalid destination")
+	}
+
+	fd, err := thisPt.getSocket(6)
+	if err != nil {
+		return err
+	}
+	addr := syscall.SockaddrInet6{}
+	copy(addr.Addr[:], dst)
+	return syscall.Sendto(fd, data, 0, &addr)
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cRawSender) Close() {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	if thisPt.fd4 > 0 {
+		syscall.Close(thisPt.fd4)
+		thisPt.fd4 = 0
+	}
+	if thisPt.fd6 > 0 {
+		syscall.Close(thisPt.fd6)
+		thisPt.fd6 = 0
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestRejectPacket(t *testing.T) {
+
+	serialize := func(l ...gopacket.SerializableLayer) []byte {
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	//TCP SYN is answered with RST
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("192.168.1.1").To4(), DstIP: net.ParseIP("1.1.1.1").To4()}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true, Seq: 1000}
+	tcp.SetNetworkLayerForChecksum(ip)
+
+	answer, dst, ok := createRejectPacket(serialize(ip, tcp))
+	if !ok || !dst.Equal(ip.SrcIP) {
+		t.Fatal("invalid reject answer")
+	}
+	packet := gopacket.NewPacket(answer, layers.LayerTypeIPv4, gopacket.Default)
+	rst, valid := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !valid || !rst.RST || !rst.ACK || rst.Ack != 1001 || rst.SrcPort != 443 || rst.DstPort != 40000 {
+		t.Fatal("invalid RST")
+	}
+
+	//RST is not answered
+	if _, _, ok := createRejectPacket(answer); ok {
+		t.Fatal("RST should not be answered")
+	}
+
+	//UDP is answered with ICMP port unreachable
+	ip.Protocol = layers.IPProtocolUDP
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	answer, _, ok = createRejectPacket(serialize(ip, udp, gopacket.Payload([]byte("query"))))
+	if !ok {
+		t.Fatal("invalid reject answer")
+	}
+	packet = gopacket.NewPacket(answer, layers.LayerTypeIPv4, gopacket.Default)
+	icmp, valid := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !valid || icmp.TypeCode.Type() != layers.ICMPv4TypeDestinationUnreachable {
+		t.Fatal("invalid ICMP")
+	}
+
+	//ICMP errors are not answered
+	if _, _, ok := createRejectPacket(answer); ok {
+		t.Fatal("ICMP errors should not be answered")
+	}
+
+	//IPv6 UDP is answered with ICMPv6
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	udp.SetNetworkLayerForChecksum(ip6)
+	answer, dst, ok = createRejectPacket(serialize(ip6, udp))
+	if !ok || !dst.Equal(ip6.SrcIP) {
+		t.Fatal("invalid reject answer")
+	}
+	packet = gopacket.NewPacket(answer, layers.LayerTypeIPv6, gopacket.Default)
+	if icmp6, valid := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); !valid || icmp6.TypeCode.Type() != layers.ICMPv6TypeDestinationUnreachable {
+		t.Fatal("invalid ICMPv6")
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+//host names are resolved again after this interval, if the resolver can not report the TTL
+const DefaultResolveInterval = 300
+
+//the minimum interval between two resolves of a host name
+const MinResolveInterval = 30
+
+const ResolveTimeOut = 5 * time.Second
+
+//---------------------------------------------------------------------------------------
+//host name resolver. it returns all the addresses of the host and the TTL of the answer.
+//the TTL is zero when it is unknown
+type IResolver interface {
+	Resolve(host string) ([]net.IP, time.Duration, error)
+}
+
+//---------------------------------------------------------------------------------------
+//system resolver implement IResolver. the standard library does not report the TTL
+type CSystemResolver struct {
+	resolver *net.Resolver
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IResolver.Resolve
+func (thisPt *CSystemResolver) Resolve(host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ResolveTimeOut)
+	defer cancel()
+
+	addrs, err := thisPt.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	out := []net.IP{}
+	for _, addr := range addrs {
+		out = append(out, addr.IP)
+	}
+	return out, 0, nil
+}
+
+//---------------------------------------------------------------------------------------
+func CreateSystemResolver() IResolver {
+	resolver := new(CSystemResolver)
+	resolver.resolver = net.DefaultResolver
+	return resolver
+}
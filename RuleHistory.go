@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//number of the kept rule sets if it is not configured
+const DefaultRuleHistorySize = 10
+
+//---------------------------------------------------------------------------------------
+//a loaded rule set. the generations of the versions are increased across the restarts when the history is stored
+//on the disk. the rules are kept in their canonical format
+type sRuleSetVersion struct {
+	SRuleSetVersion
+	Rules CJsonRuleRepository `json:"rules"`
+}
+
+//---------------------------------------------------------------------------------------
+//the last loaded rule sets, the oldest ones are removed. a new version is added just when the rules are changed.
+//the pinned version is the activated version, it stays active until the rules of the repository are activated again.
+//the files are written after releasing lock, diskLock keeps the order of the writes
+type cRuleHistory struct {
+	dir      string
+	size     int
+	lock     sync.Mutex
+	diskLock sync.Mutex
+	versions []*sRuleSetVersion
+	active   uint64
+	pinned   uint64
+	last     uint64
+}
+
+//---------------------------------------------------------------------------------------
+//the pinned version in the directory of the history
+type sPinnedRuleSet struct {
+	Pinned uint64 `json:"pinned"`
+}
+
+//---------------------------------------------------------------------------------------
+//hash of the rules, groups, pools and exempt networks
+func getRuleSetHash(rules *CJsonRuleRepository) string {
+	data, _ := json.Marshal(rules)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//---------------------------------------------------------------------------------------
+func getRuleSetFileName(dir string, generation uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("ruleset-%d.json", generation))
+}
+
+//---------------------------------------------------------------------------------------
+//the versions are kept in the memory if they can not be saved
+func saveRuleSetVersion(dir string, version *sRuleSetVersion) {
+	if len(dir) == 0 {
+		return
+	}
+	data, _ := json.MarshalIndent(version, "", "  ")
+	if err := writeFileAtomic(getRuleSetFileName(dir, version.Generation), data); err != nil {
+		log.Printf("can not save the rules version %d, %v \n", version.Generation, err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+func removeRuleSetVersions(dir string, generations []uint64) {
+	if len(dir) == 0 {
+		return
+	}
+	for _, generation := range generations {
+		if err := os.Remove(getRuleSetFileName(dir, generation)); err != nil && !os.IsNotExist(err) {
+			log.Printf("can not remove the rules version %d, %v \n", generation, err)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//the pinned version is restored after a restart
+func savePinnedRuleSet(dir string, pinned uint64) {
+	if len(dir) == 0 {
+		return
+	}
+	fileName := filepath.Join(dir, "pinned.json")
+	if pinned == 0 {
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			log.Printf("can not remove the pinned rules version, %v \n", err)
+		}
+		return
+	}
+	data, _ := json.Marshal(sPinnedRuleSet{Pinned: pinned})
+	if err := writeFileAtomic(fileName, data); err != nil {
+		log.Printf("can not save the pinned rules version %d, %v \n", pinned, err)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//remove the oldest versions, the active and the pinned versions are kept. returns the generations of the removed
+//versions, their files are removed by the caller
+func (thisPt *cRuleHistory) prune() []uint64 {
+	removed := []uint64{}
+	for i := 0; len(thisPt.versions) > thisPt.size && i < len(thisPt.versions); {
+		version := thisPt.versions[i]
+		if version.Generation == thisPt.active || version.Generation == thisPt.pinned {
+			i++
+			continue
+		}
+		thisPt.versions = append(thisPt.versions[:i], thisPt.versions[i+1:]...)
+		removed = append(removed, version.Generation)
+	}
+	return removed
+}
+
+//---------------------------------------------------------------------------------------
+//add the rules as the active version. the rules are not added again if they are the same as the last version.
+//returns the generation of the version
+func (thisPt *cRuleHistory) add(rules CJsonRuleRepository, now int64) uint64 {
+	thisPt.diskLock.Lock()
+	defer thisPt.diskLock.Unlock()
+	thisPt.lock.Lock()
+
+	hash := getRuleSetHash(&rules)
+	if count := len(thisPt.versions); count > 0 && thisPt.versions[count-1].Hash == hash {
+		thisPt.active = thisPt.versions[count-1].Generation
+		thisPt.lock.Unlock()
+		return thisPt.active
+	}
+
+	thisPt.last++
+	version := &sRuleSetVersion{Rules: rules}
+	version.Generation = thisPt.last
+	version.Time = now
+	version.Hash = hash
+	version.RuleCount = len(rules.Rules)
+	thisPt.versions = append(thisPt.versions, version)
+	thisPt.active = version.Generation
+	removed := thisPt.prune()
+	dir := thisPt.dir
+	thisPt.lock.Unlock()
+
+	saveRuleSetVersion(dir, version)
+	removeRuleSetVersions(dir, removed)
+	return version.Generation
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cRuleHistory) get(generation uint64) (*sRuleSetVersion, error) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	for _, version := range thisPt.versions {
+		if version.Generation == generation {
+			return version, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown rules version %d", generation)
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cRuleHistory) getActive() uint64 {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	return thisPt.active
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cRuleHistory) getPinned() uint64 {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	return thisPt.pinned
+}
+
+//---------------------------------------------------------------------------------------
+//activate and pin a version, 0 unpins the active version
+func (thisPt *cRuleHistory) pin(generation uint64) {
+	thisPt.diskLock.Lock()
+	defer thisPt.diskLock.Unlock()
+	thisPt.lock.Lock()
+	if generation != 0 {
+		thisPt.active = generation
+	}
+	thisPt.pinned = generation
+	dir := thisPt.dir
+	thisPt.lock.Unlock()
+
+	savePinnedRuleSet(dir, generation)
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *cRuleHistory) dump() SRuleSetHistory {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	history := SRuleSetHistory{Active: thisPt.active, Pinned: thisPt.pinned, Versions: []SRuleSetVersion{}}
+	for _, version := range thisPt.versions {
+		history.Versions = append(history.Versions, version.SRuleSetVersion)
+	}
+	return history
+}
+
+//---------------------------------------------------------------------------------------
+//replace the versions with the versions stored in the directory. the invalid files are ignored. the new versions
+//are stored in the directory too. the pinned version is loaded if it is kept
+func (thisPt *cRuleHistory) load(dir string, size int) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "ruleset-*.json"))
+	if err != nil {
+		return err
+	}
+
+	versions := []*sRuleSetVersion{}
+	hashFailed := map[uint64]bool{}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		version := new(sRuleSetVersion)
+		if err := json.Unmarshal(data, version); err != nil || version.Generation == 0 {
+			log.Printf("invalid rules version %s is ignored \n", filepath.Base(name))
+			continue
+		}
+		if getRuleSetHash(&version.Rules) != version.Hash {
+			log.Printf("rules version %s is ignored, its hash check failed \n", filepath.Base(name))
+			hashFailed[version.Generation] = true
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Generation < versions[j].Generation })
+
+	pinned := sPinnedRuleSet{}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "pinned.json")); err == nil {
+		if err := json.Unmarshal(data, &pinned); err != nil {
+			log.Printf("invalid pinned rules version is ignored \n")
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	thisPt.dir = dir
+	thisPt.size = size
+	thisPt.versions = versions
+	thisPt.active = 0
+	thisPt.pinned = 0
+	thisPt.last = 0
+	for _, version := range versions {
+		if version.Generation == pinned.Pinned {
+			thisPt.pinned = pinned.Pinned
+		}
+	}
+	if pinned.Pinned != 0 && thisPt.pinned == 0 {
+		if hashFailed[pinned.Pinned] {
+			log.Printf("pinned rules version %d can not be restored, its hash check failed \n", pinned.Pinned)
+		} else {
+			log.Printf("pinned rules version %d can not be restored, it is not kept \n", pinned.Pinned)
+		}
+	}
+	if len(versions) > 0 {
+		thisPt.last = versions[len(versions)-1].Generation
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+func createRuleHistory(size int) *cRuleHistory {
+	history := new(cRuleHistory)
+	history.size = size
+	return history
+}
+
+//---------------------------------------------------------------------------------------
+//the rules are compared by their names. the rules with the same name are compared in their order
+func diffRuleSets(from *sRuleSetVersion, to *sRuleSetVersion) SRuleSetDiff {
+	getKeys := func(rules []SRule) ([]string, map[string]SRule) {
+		keys := []string{}
+		items := map[string]SRule{}
+		counts := map[string]int{}
+		for _, rule := range rules {
+			key := fmt.Sprintf("%s#%d", rule.Name, counts[rule.Name])
+			counts[rule.Name]++
+			keys = append(keys, key)
+			items[key] = rule
+		}
+		return keys, items
+	}
+	fromKeys, fromRules := getKeys(from.Rules.Rules)
+	toKeys, toRules := getKeys(to.Rules.Rules)
+
+	diff := SRuleSetDiff{From: from.Generation, To: to.Generation, Added: []SRule{}, Removed: []SRule{}, Changed: []SRuleChange{}, Other: []string{}}
+	for _, key := range fromKeys {
+		if _, fnd := toRules[key]; !fnd {
+			diff.Removed = append(diff.Removed, fromRules[key])
+		}
+	}
+	for _, key := range toKeys {
+		fromRule, fnd := fromRules[key]
+		if !fnd {
+			diff.Added = append(diff.Added, toRules[key])
+			continue
+		}
+		fromData, _ := json.Marshal(fromRule)
+		toData, _ := json.Marshal(toRules[key])
+		if string(fromData) != string(toData) {
+			diff.Changed = append(diff.Changed, SRuleChange{Name: toRules[key].Name, From: fromRule, To: toRules[key]})
+		}
+	}
+
+	getJson := func(item interface{}) string {
+		data, _ := json.Marshal(item)
+		return string(data)
+	}
+	if getJson(from.Rules.Groups) != getJson(to.Rules.Groups) {
+		diff.Other = append(diff.Other, "groups")
+	}
+	if getJson(from.Rules.Pools) != getJson(to.Rules.Pools) {
+		diff.Other = append(diff.Other, "pools")
+	}
+	if strings.Join(from.Rules.Exempt, ",") != strings.Join(to.Rules.Exempt, ",") {
+		diff.Other = append(diff.Other, "exempt_networks")
+	}
+	return diff
+}
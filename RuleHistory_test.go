@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRuleHistory(t *testing.T) {
+	repos := new(CJsonRuleRepository)
+	setRules := func(rules string) {
+		if err := repos.loadRulesFromString(rules); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setRules(`{"rules":[{"name":"first","destination":"10.6.0.0/16","usage_size":"2kb","protocol":"any"}]}`)
+
+	clock := &cFakeClock{now: time.Unix(1000, 0)}
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher, err := CreateMatcher(repos, conv, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matcher.Close()
+	getHistory := func() SRuleSetHistory {
+		history := SRuleSetHistory{}
+		if err := json.Unmarshal([]byte(matcher.DumpRuleVersions()), &history); err != nil {
+			t.Fatal(err)
+		}
+		return history
+	}
+
+	//the same rules do not add any version
+	if err := matcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	setRules(`{"rules":[{"name":"first","destination":"10.6.0.0/16","usage_size":"4kb","protocol":"any"},{"name":"second","destination":"10.7.0.0/16","protocol":"any"}]}`)
+	if err := matcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	setRules(`{"rules":[{"name":"second","destination":"10.7.0.0/16","protocol":"any","action":"reject"}]}`)
+	if err := matcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	history := getHistory()
+	if history.Active != 3 || len(history.Versions) != 3 || history.Versions[0].Time != 1000 || history.Versions[1].RuleCount != 2 || history.Versions[0].Hash == history.Versions[2].Hash {
+		t.Fatalf("invalid history %+v", history)
+	}
+
+	diff := SRuleSetDiff{}
+	out, err := matcher.DiffRuleVersions(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(out), &diff); err != nil {
+		t.Fatal(err)
+	}
+	if diff.To != 3 || len(diff.Removed) != 1 || diff.Removed[0].Name != "first" || len(diff.Added) != 1 || diff.Added[0].Name != "second" || len(diff.Changed) != 0 {
+		t.Fatalf("invalid diff %+v", diff)
+	}
+	out, _ = matcher.DiffRuleVersions(1, 2)
+	json.Unmarshal([]byte(out), &diff)
+	if len(diff.Changed) != 1 || diff.Changed[0].From.UsageSize != "2kb" || diff.Changed[0].To.UsageSize != "4kb" {
+		t.Fatalf("invalid diff %+v", diff)
+	}
+	if _, err := matcher.DiffRuleVersions(1, 9); err == nil {
+		t.Fatal("unknown version should be rejected")
+	}
+
+	//roll back, the conversations keep their counters
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("10.6.0.1").To4()
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_TCP
+	packet.DataSize = 500
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "" {
+		t.Fatal("the last rules should be active")
+	}
+	if err := matcher.ActivateRuleVersion(1); err != nil {
+		t.Fatal(err)
+	}
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "first" || verdict.Result != PacketProcessResultOK {
+		t.Fatal("the first version should be active")
+	}
+	if history := getHistory(); history.Active != 1 || history.Pinned != 1 || len(history.Versions) != 3 {
+		t.Fatalf("invalid history %+v", history)
+	}
+	if err := matcher.ActivateRuleVersion(9); err == nil {
+		t.Fatal("unknown version should be rejected")
+	}
+
+	//the reloads do not replace the pinned version until the rules of the repository are activated again
+	setRules(`{"rules":[{"name":"second","destination":"10.7.0.0/16","protocol":"any","action":"drop"}]}`)
+	if err := matcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	status := SRuleReloadStatus{}
+	json.Unmarshal([]byte(matcher.DumpReloadStatus()), &status)
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "first" || status.Version != 1 || !status.Pinned || len(getHistory().Versions) != 3 {
+		t.Fatalf("the pinned version should be active, %+v", status)
+	}
+	if err := matcher.ActivateRuleVersion(0); err != nil {
+		t.Fatal(err)
+	}
+	if history := getHistory(); history.Active != 4 || history.Pinned != 0 || len(history.Versions) != 4 {
+		t.Fatalf("invalid history %+v", history)
+	}
+
+	//the versions are stored on the disk and their generations continue after a restart
+	dir := filepath.Join(t.TempDir(), "history")
+	if err := matcher.SetRuleHistory(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	if history := getHistory(); history.Active != 1 || len(history.Versions) != 1 {
+		t.Fatalf("invalid history %+v", history)
+	}
+	setRules(`{"rules":[{"name":"third","destination":"10.8.0.0/16","protocol":"any"}]}`)
+	if err := matcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	setRules(`{"rules":[{"name":"fourth","destination":"10.9.0.0/16","protocol":"any"}]}`)
+	if err := matcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := CreateMatcher(repos, conv, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if err := other.SetRuleHistory(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	history = SRuleSetHistory{}
+	json.Unmarshal([]byte(other.DumpRuleVersions()), &history)
+	if history.Active != 3 || len(history.Versions) != 2 || history.Versions[0].Generation != 2 {
+		t.Fatalf("invalid history %+v", history)
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "ruleset-*.json"))
+	if len(names) != 2 {
+		t.Fatalf("invalid files %v", names)
+	}
+
+	//the pinned version is activated again after a restart
+	if err := other.ActivateRuleVersion(2); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := CreateMatcher(repos, conv, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if err := restarted.SetRuleHistory(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	history = SRuleSetHistory{}
+	json.Unmarshal([]byte(restarted.DumpRuleVersions()), &history)
+	packet.DIp = net.ParseIP("10.8.0.1").To4()
+	if verdict := restarted.Match(&packet, 0); verdict.RuleName != "third" || history.Active != 2 || history.Pinned != 2 {
+		t.Fatalf("the pinned version should be active, %+v", history)
+	}
+	//the pinned version is not restored when its hash check fails
+	fileName := filepath.Join(dir, "ruleset-2.json")
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, bytes.Replace(data, []byte("10.8.0.0/16"), []byte("10.8.0.0/24"), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tampered, err := CreateMatcher(repos, conv, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tampered.Close()
+	if err := tampered.SetRuleHistory(dir, 2); err != nil {
+		t.Fatal(err)
+	}
+	history = SRuleSetHistory{}
+	json.Unmarshal([]byte(tampered.DumpRuleVersions()), &history)
+	if history.Pinned != 0 || len(history.Versions) != 1 || history.Versions[0].Generation != 3 {
+		t.Fatalf("the tampered version should not be restored, %+v", history)
+	}
+}
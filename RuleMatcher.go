@@ -1,103 +1,318 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
-	"regexp"
-	"strconv"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 //---------------------------------------------------------------------------------------
 type sCompiledRule struct {
 	Name      string
+	Origin    string
+	Type      int
+	Priority  int
 	DataLimit int64
 	TimeLimit int64
+	TimeMode  int
 	Protocol  uint16
-	Network   string
+	Action    int
+	Mark      uint32
+	Throttle  int64
+	RateLimit int64
+	RateBurst int64
+	RateAfter int64
+	RateDelay bool
+	Networks  []string
+	Host      string
+	Sources   sSourceSelector
+	Schedule  *sSchedule
+	Pool      *sQuotaPool
 }
 
 type sCompiledRulesList []sCompiledRule
 
+//---------------------------------------------------------------------------------------
+//resolved addresses of a host name destination
+type sResolvedHost struct {
+	networks    []string
+	nextResolve int64
+}
+
+//---------------------------------------------------------------------------------------
+//result of the rule reloads. version is the generation of the active rules version, see /rules/versions
+type SRuleReloadStatus struct {
+	Version       uint64 `json:"version"`
+	Pinned        bool   `json:"pinned"`
+	Reloads       uint64 `json:"reloads"`
+	Failures      uint64 `json:"failures"`
+	LastReload    int64  `json:"last_reload"`
+	LastError     string `json:"last_error"`
+	LastErrorTime int64  `json:"last_error_time"`
+}
+
 //---------------------------------------------------------------------------------------
 type CRuleMatcher struct {
-	defaultRules        sCompiledRulesList
+	cEventPublisher
+	ruleSet             *sRuleSet
 	accessLock          sync.RWMutex
-	ruleParseRegx       *regexp.Regexp
-	ipTri               cIPTrie
+	reloadLock          sync.Mutex
 	ruleRepos           IRuleRepository
 	conversationTracker IConversationTracker
+	resolver            IResolver
+	clock               IClock
+	evaluationMode      int
+	sizeUnits           int
+	generation          uint64
+	disableRuleCache    bool
+	disableSourceMAC    bool
+	reloadStatus        SRuleReloadStatus
+	reloadStatusLock    sync.Mutex
+	reposLock           sync.Mutex
+	pools               map[string]*sQuotaPool
+	hosts               map[string]*sResolvedHost
+	activeRules         CJsonRuleRepository
+	history             *cRuleHistory
+	subscriberNetworks  []*net.IPNet
+	stop                chan struct{}
+	stopOnce            sync.Once
 }
 
 //---------------------------------------------------------------------------------------
-func (thisPt *CRuleMatcher) getValues(item string) (int64, string, error) {
-	//var re =
+//resolve all the addresses of a host name and convert them to host networks
+func (thisPt *CRuleMatcher) resolveHost(host string, now int64) (*sResolvedHost, error) {
+	ips, ttl, err := thisPt.resolver.Resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no address")
+	}
+
+	networks := []string{}
+	for _, ip := range ips {
+		network := fmt.Sprintf("%s/128", ip.String())
+		if ip.To4() != nil {
+			network = fmt.Sprintf("%s/32", ip.String())
+		}
+		networks = append(networks, network)
+	}
 
-	out := thisPt.ruleParseRegx.FindAllStringSubmatch(item, -1)
-	if len(out[0]) != 3 {
-		return 0, "", errors.New("invalid value")
+	//keep the order stable to detect the changes
+	sort.Strings(networks)
+	unique := networks[:1]
+	for _, network := range networks[1:] {
+		if network != unique[len(unique)-1] {
+			unique = append(unique, network)
+		}
 	}
 
-	nVal, _ := strconv.Atoi(out[0][1])
+	//respect the TTL if the resolver reports it
+	interval := int64(ttl / time.Second)
+	if interval == 0 {
+		interval = DefaultResolveInterval
+	} else if interval < MinResolveInterval {
+		interval = MinResolveInterval
+	}
 
-	return int64(nVal), strings.ToLower(out[0][2]), nil
+	return &sResolvedHost{networks: unique, nextResolve: now + interval}, nil
+}
+
+//---------------------------------------------------------------------------------------
+//convert the rule sources to a selector. sources could be networks, IP addresses or group names
+func (thisPt *CRuleMatcher) compileSources(sources []string, groups map[string]SGroup) (sSourceSelector, error) {
+	selector := sSourceSelector{}
+	keys := []string{}
+
+	var addItem func(item string, inGroup bool) error
+	addItem = func(item string, inGroup bool) error {
+		if _, network, err := net.ParseCIDR(item); err == nil {
+			selector.Networks = append(selector.Networks, network)
+			keys = append(keys, network.String())
+		} else if ip := net.ParseIP(item); ip != nil {
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			network := &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			selector.Networks = append(selector.Networks, network)
+			keys = append(keys, network.String())
+		} else if mac, err := net.ParseMAC(item); err == nil {
+			if thisPt.disableSourceMAC {
+				return fmt.Errorf("MAC address %s is not supported, the packets have no source MAC", item)
+			}
+			selector.MACs = append(selector.MACs, mac.String())
+			keys = append(keys, mac.String())
+		} else if group, fnd := groups[item]; fnd && !inGroup {
+			for _, member := range group.Members {
+				if err := addItem(member, true); err != nil {
+					return err
+				}
+			}
+		} else if inGroup {
+			return fmt.Errorf("invalid group member %s", item)
+		} else {
+			return fmt.Errorf("invalid source %s", item)
+		}
+		return nil
+	}
+
+	for _, source := range sources {
+		if err := addItem(source, false); err != nil {
+			return selector, err
+		}
+	}
+
+	//used to detect the duplicate rules
+	sort.Strings(keys)
+	selector.Key = strings.Join(keys, ",")
+	return selector, nil
 }
 
 //---------------------------------------------------------------------------------------
 //convert SRule to sCompiledRules
-func (thisPt *CRuleMatcher) compileRule(rule SRule) (sCompiledRule, error) {
+func (thisPt *CRuleMatcher) compileRule(rule SRule, hosts map[string]*sResolvedHost, groups map[string]SGroup, pools map[string]*sQuotaPool) (sCompiledRule, error) {
 	cmpRule := sCompiledRule{}
 
 	cmpRule.Name = rule.Name
-	cmpRule.Network = rule.Destination
+	cmpRule.Origin = rule.Origin
+	cmpRule.Priority = rule.Priority
+	cmpRule.Type = GetRuleTypeNumber(rule.Type)
+	if rule.Type != "" && rule.Type != "quota" && cmpRule.Type == RuleTypeQuota {
+		return cmpRule, newRuleError(rule.Name, "type", "invalid rule type")
+	}
+	cmpRule.Networks = []string{rule.Destination}
 	cmpRule.Protocol = GetProtocolNumber(rule.L4Protocol)
 
-	//check destination
+	//check destination. host names are resolved to all of their addresses
 	if _, _, err := net.ParseCIDR(rule.Destination); err != nil {
-		if ip, err := net.ResolveIPAddr("ip", rule.Destination); err != nil {
-			return cmpRule, errors.New("invalid network")
-		} else {
-			cmpRule.Network = fmt.Sprintf("%s/32", ip.String())
+		host, fnd := hosts[rule.Destination]
+		if !fnd {
+			if host, err = thisPt.resolveHost(rule.Destination, thisPt.clock.Now().Unix()); err != nil {
+				return cmpRule, newRuleError(rule.Name, "destination", fmt.Sprintf("invalid network or host, %v", err))
+			}
+			hosts[rule.Destination] = host
 		}
+		cmpRule.Host = rule.Destination
+		cmpRule.Networks = host.networks
+	}
+
+	//check sources
+	sources, err := thisPt.compileSources(rule.Sources, groups)
+	if err != nil {
+		return cmpRule, newRuleError(rule.Name, "sources", err.Error())
+	}
+	cmpRule.Sources = sources
+
+	//check schedule
+	if cmpRule.Schedule, err = compileSchedule(rule.Schedule); err != nil {
+		return cmpRule, newRuleError(rule.Name, "schedule", err.Error())
 	}
 
 	cmpRule.TimeLimit = -1
 	cmpRule.DataLimit = -1
 
+	//check time accounting mode
+	if rule.TimeMode != "" && rule.TimeMode != "wall" && rule.TimeMode != "active" {
+		return cmpRule, newRuleError(rule.Name, "usage_time_mode", "invalid time mode")
+	}
+	cmpRule.TimeMode = GetTimeModeNumber(rule.TimeMode)
+
+	//check action
+	if rule.Action != "" && rule.Action != "drop" && GetRuleActionNumber(rule.Action) == RuleActionDrop {
+		return cmpRule, newRuleError(rule.Name, "action", "invalid action")
+	}
+	cmpRule.Action = GetRuleActionNumber(rule.Action)
+	cmpRule.Mark = rule.Mark
+	if cmpRule.Action == RuleActionMark && cmpRule.Mark == 0 {
+		return cmpRule, newRuleError(rule.Name, "mark", "mark action needs a mark")
+	}
+	if cmpRule.Mark&RejectPacketMark != 0 {
+		return cmpRule, newRuleError(rule.Name, "mark", fmt.Sprintf("mark bit %#x is reserved for the reject answers", RejectPacketMark))
+	}
+
+	//throttle rate in bits per second
+	if cmpRule.Action == RuleActionThrottle {
+		if cmpRule.Throttle, err = parseRate(rule.ThrottleTo); err != nil {
+			return cmpRule, newRuleError(rule.Name, "throttle_rate", err.Error())
+		}
+	}
+
+	//process rate limit
+	cmpRule.RateAfter = -1
+	if len(rule.RateLimit) > 0 {
+		if cmpRule.RateLimit, err = parseRate(rule.RateLimit); err != nil {
+			return cmpRule, newRuleError(rule.Name, "rate_limit", err.Error())
+		}
+
+		//one second of traffic by default. the burst should pass a full size packet
+		cmpRule.RateBurst = cmpRule.RateLimit / 8
+		if cmpRule.RateBurst < MinRateLimitBurst {
+			cmpRule.RateBurst = MinRateLimitBurst
+		}
+		if len(rule.RateBurst) > 0 {
+			if cmpRule.RateBurst, err = parseSize(rule.RateBurst, thisPt.sizeUnits); err != nil {
+				return cmpRule, newRuleError(rule.Name, "rate_limit_burst", err.Error())
+			}
+			if cmpRule.RateBurst < MinRateLimitBurst {
+				return cmpRule, newRuleError(rule.Name, "rate_limit_burst", fmt.Sprintf("should be at least %db, one MTU", MinRateLimitBurst))
+			}
+		}
+
+		if len(rule.RateAfter) > 0 {
+			if cmpRule.RateAfter, err = parseSize(rule.RateAfter, thisPt.sizeUnits); err != nil {
+				return cmpRule, newRuleError(rule.Name, "rate_limit_after", err.Error())
+			}
+		}
+
+		if rule.RateAction != "" && rule.RateAction != "drop" && rule.RateAction != "delay" {
+			return cmpRule, newRuleError(rule.Name, "rate_limit_action", "invalid rate limit action")
+		}
+		cmpRule.RateDelay = rule.RateAction == "delay"
+	}
+
+	//allow and deny rules short-circuit the quota evaluation
+	if cmpRule.Type != RuleTypeQuota {
+		if len(rule.UsageSize) > 0 || len(rule.UsageTime) > 0 || len(rule.RateLimit) > 0 || len(rule.Pool) > 0 {
+			return cmpRule, newRuleError(rule.Name, "type", "allow and deny rules can not have any quota")
+		}
+		if cmpRule.Type == RuleTypeDeny && cmpRule.Action != RuleActionDrop && cmpRule.Action != RuleActionReject {
+			return cmpRule, newRuleError(rule.Name, "action", "deny rules just support the drop and reject actions")
+		}
+	}
+
+	//the data quota of the pool rules is the pool
+	if len(rule.Pool) > 0 {
+		pool, fnd := pools[rule.Pool]
+		if !fnd {
+			return cmpRule, newRuleError(rule.Name, "pool", fmt.Sprintf("unknown pool %s", rule.Pool))
+		}
+		if len(rule.UsageSize) > 0 {
+			return cmpRule, newRuleError(rule.Name, "usage_size", "pool rules can not have usage_size")
+		}
+		cmpRule.Pool = pool
+	}
+
 	//process data
 	if len(rule.UsageSize) > 0 {
-		if data, unit, err := thisPt.getValues(rule.UsageSize); err == nil {
-			if unit == "kb" {
-				cmpRule.DataLimit = int64(data * 1024)
-			} else if unit == "mb" {
-				cmpRule.DataLimit = int64(data * 1024 * 1024)
-			} else if unit == "gb" {
-				cmpRule.DataLimit = int64(data * 1024 * 1024 * 1024)
-			} else {
-				return cmpRule, errors.New("invalid usage unit")
-			}
-		} else {
-			return cmpRule, errors.New("invalid usage value")
+		if cmpRule.DataLimit, err = parseSize(rule.UsageSize, thisPt.sizeUnits); err != nil {
+			return cmpRule, newRuleError(rule.Name, "usage_size", err.Error())
 		}
 	}
 
 	//process time
 	if len(rule.UsageTime) > 0 {
-		if data, unit, err := thisPt.getValues(rule.UsageTime); err == nil {
-			if unit == "s" {
-				cmpRule.TimeLimit = data
-			} else if unit == "m" {
-				cmpRule.TimeLimit = int64(data * 60)
-			} else if unit == "h" {
-				cmpRule.TimeLimit = int64(data * 3600)
-			} else {
-				return cmpRule, errors.New("invalid time unit")
-			}
-		} else {
-			return cmpRule, errors.New("invalid time value")
+		if cmpRule.TimeLimit, err = parseDuration(rule.UsageTime); err != nil {
+			return cmpRule, newRuleError(rule.Name, "usage_time", err.Error())
 		}
 	}
 
@@ -105,166 +320,850 @@ func (thisPt *CRuleMatcher) compileRule(rule SRule) (sCompiledRule, error) {
 }
 
 //---------------------------------------------------------------------------------------
-//return all the possible rules for a network
-func (thisPt *CRuleMatcher) findRule(ip net.IP, protocol uint16) (bool, sCompiledRule) {
-
-	//find best matched rule
-	findBestRuleInRuleList := func(list *sCompiledRulesList, protocol uint16) (bool, sCompiledRule) {
-		best := -1
-		for i, rule := range *list {
-			if rule.Protocol == protocol {
-				best = i
-				break
-			} else if rule.Protocol == PROTOCOL_ANY {
-				best = i
-			}
-		}
-		if best != -1 {
-			return true, (*list)[best]
-		}
-		return false, sCompiledRule{}
+//the rule with its quantities in the canonical format, the active rules are shown in this format
+func getCanonicalRule(rule SRule, cmpRule sCompiledRule, sizeUnits int) SRule {
+	formatRuleSize := func(size int64) string {
+		return formatSize(size, sizeUnits)
 	}
-
-	//check ip TRI
-	if ruleListIn := thisPt.ipTri.Search(ip); ruleListIn != nil {
-		return findBestRuleInRuleList(ruleListIn.(*sCompiledRulesList), protocol)
+	rule.UsageSize = formatLimit(cmpRule.DataLimit, formatRuleSize)
+	rule.UsageTime = formatLimit(cmpRule.TimeLimit, formatDuration)
+	if cmpRule.Action == RuleActionThrottle {
+		rule.ThrottleTo = formatRate(cmpRule.Throttle)
 	}
+	if len(rule.RateLimit) > 0 {
+		rule.RateLimit = formatRate(cmpRule.RateLimit)
+		rule.RateBurst = formatRuleSize(cmpRule.RateBurst)
+		rule.RateAfter = formatLimit(cmpRule.RateAfter, formatRuleSize)
+	}
+	return rule
+}
 
-	//check for default rules
-	return findBestRuleInRuleList(&thisPt.defaultRules, protocol)
+//---------------------------------------------------------------------------------------
+//load the rules of the repository and add them to the history. the rules are not loaded while a version is
+//pinned, the pinned version is returned
+func (thisPt *CRuleMatcher) loadRules() (uint64, error) {
+
+	//reposLock is always locked before reloadLock
+	thisPt.reposLock.Lock()
+	defer thisPt.reposLock.Unlock()
+	thisPt.reloadLock.Lock()
+	defer thisPt.reloadLock.Unlock()
+
+	if pinned := thisPt.history.getPinned(); pinned != 0 {
+		return pinned, nil
+	}
+	if err := thisPt.compileRules(thisPt.ruleRepos); err != nil {
+		return 0, err
+	}
+	thisPt.history.add(thisPt.activeRules, thisPt.clock.Now().Unix())
+	return 0, nil
 }
 
 //---------------------------------------------------------------------------------------
-func (thisPt *CRuleMatcher) loadRules() error {
+//compile the rules and replace the active rules. reloadLock should be locked. the rules of one snapshot of the
+//repository are compiled
+func (thisPt *CRuleMatcher) compileRules(ruleRepos IRuleRepository) error {
 
-	thisPt.accessLock.Lock()
-	defer thisPt.accessLock.Unlock()
+	//We should first make sure about the correctness of the rules. After that, we can replace the existing rules
+	snapshot := ruleRepos.GetSnapshot()
+	rules := snapshot.Rules
+	groups := map[string]SGroup{}
+	for _, g := range snapshot.Groups {
+		for _, member := range g.Members {
+			if _, err := net.ParseMAC(member); err == nil && thisPt.disableSourceMAC {
+				return newRuleError("", "groups", fmt.Sprintf("MAC address %s of group %s is not supported, the packets have no source MAC", member, g.Name))
+			}
+		}
+		groups[g.Name] = g
+	}
+
+	//keep the usage of the existing pools. their new sizes are applied after the reload
+	pools := map[string]*sQuotaPool{}
+	sizes := map[string]int64{}
+	for _, p := range snapshot.Pools {
+		if _, fnd := pools[p.Name]; fnd {
+			return newRuleError("", "pools", fmt.Sprintf("duplicate pool %s", p.Name))
+		}
+		size, err := parseSize(p.Size, thisPt.sizeUnits)
+		if err != nil {
+			return newRuleError("", "pools", fmt.Sprintf("invalid size of pool %s, %v", p.Name, err))
+		}
+		if pool, fnd := thisPt.pools[p.Name]; fnd {
+			pools[p.Name] = pool
+		} else {
+			pools[p.Name] = &sQuotaPool{Name: p.Name, Size: size}
+		}
+		sizes[p.Name] = size
+	}
 
-	//We should first make sure about the correctness of the rules. After that, we can free existing rules and add them to the Tri
-	rules := thisPt.ruleRepos.GetRules()
 	cmpRules := []sCompiledRule{}
+	hosts := map[string]*sResolvedHost{}
+	active := CJsonRuleRepository{Groups: snapshot.Groups, Exempt: snapshot.Exempt}
 	for _, r := range rules {
-		if cmpRule, err := thisPt.compileRule(r); err != nil {
+		if cmpRule, err := thisPt.compileRule(r, hosts, groups, pools); err != nil {
+			ruleErr := new(SRuleError)
+			if errors.As(err, &ruleErr) {
+				ruleErr.Origin = r.Origin
+			}
 			return err
 		} else {
 			cmpRules = append(cmpRules, cmpRule)
+			active.Rules = append(active.Rules, getCanonicalRule(r, cmpRule, thisPt.sizeUnits))
 		}
 	}
+	for _, p := range snapshot.Pools {
+		active.Pools = append(active.Pools, SPool{Name: p.Name, Size: formatSize(sizes[p.Name], thisPt.sizeUnits)})
+	}
 
-	//check for duplicate rules for a subnet
-	checkForDuplicate := func(ruleList *sCompiledRulesList, protocol uint16) bool {
-		for _, r := range *ruleList {
-			if r.Protocol == protocol {
-				return true
-			}
+	//exempt networks are never tracked
+	exempt := []*net.IPNet{}
+	for _, item := range snapshot.Exempt {
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return newRuleError("", "exempt_networks", fmt.Sprintf("invalid network %s", item))
 		}
-		return false
+		exempt = append(exempt, network)
 	}
 
+	ruleSet, err := createRuleSet(cmpRules, exempt)
+	if err != nil {
+		return err
+	}
+
+	//a new generation invalidates the rules cached in the conversations
+	thisPt.generation++
+	ruleSet.generation = thisPt.generation
+
 	//every thing seems good :)
-	defaultRules := sCompiledRulesList{}
-	thisPt.ipTri.Flush()
-	for _, cmp := range cmpRules {
-
-		//We may have different rules for each protocol in a subnet for example 192.168.1.0:udp and 192.168.1.0:tcp or 192.168.1.0:any
-		var ruleList *sCompiledRulesList
-
-		//default policy
-		if cmp.Network == DEFAULT_NET {
-			ruleList = &defaultRules
-		} else if listInter := thisPt.ipTri.SearchExactString(cmp.Network); listInter != nil {
-			ruleList = listInter.(*sCompiledRulesList)
-		} else {
-			ruleList = new(sCompiledRulesList)
-			if err := thisPt.ipTri.AddString(cmp.Network, ruleList); err != nil {
-				return err
-			}
+	thisPt.accessLock.Lock()
+	for name, pool := range pools {
+		atomic.StoreInt64(&pool.Size, sizes[name])
+	}
+	thisPt.ruleSet = ruleSet
+	thisPt.pools = pools
+	thisPt.hosts = hosts
+	thisPt.activeRules = active
+	thisPt.accessLock.Unlock()
+
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+//resolve the host names again and replace the rule set if their addresses are changed
+func (thisPt *CRuleMatcher) refreshHosts(now int64) {
+
+	thisPt.reloadLock.Lock()
+	defer thisPt.reloadLock.Unlock()
+
+	changed := false
+	for name, host := range thisPt.hosts {
+		if now < host.nextResolve {
+			continue
 		}
 
-		//check for duplicate rules
-		if checkForDuplicate(ruleList, cmp.Protocol) {
-			return errors.New("duplicate rules detected")
+		newHost, err := thisPt.resolveHost(name, now)
+		if err != nil {
+			//keep the last known addresses
+			log.Printf("can not resolve %s, %v \n", name, err)
+			host.nextResolve = now + MinResolveInterval
+			continue
 		}
 
-		*ruleList = append(*ruleList, cmp)
+		if strings.Join(newHost.networks, ",") != strings.Join(host.networks, ",") {
+			changed = true
+		}
+		thisPt.hosts[name] = newHost
 	}
 
-	//set default routes
-	thisPt.defaultRules = defaultRules
+	if !changed {
+		return
+	}
 
-	return nil
+	//build a new rule set with the new addresses
+	cmpRules := []sCompiledRule{}
+	for _, cmp := range thisPt.ruleSet.rules {
+		if len(cmp.Host) > 0 {
+			cmp.Networks = thisPt.hosts[cmp.Host].networks
+		}
+		cmpRules = append(cmpRules, cmp)
+	}
+
+	ruleSet, err := createRuleSet(cmpRules, thisPt.ruleSet.exempt)
+	if err != nil {
+		log.Printf("can not update the host rules, %v \n", err)
+		return
+	}
+	thisPt.generation++
+	ruleSet.generation = thisPt.generation
+
+	thisPt.accessLock.Lock()
+	thisPt.ruleSet = ruleSet
+	thisPt.accessLock.Unlock()
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CRuleMatcher) startResolveProcess() {
+	go func() {
+		ticker := time.NewTicker(1 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-thisPt.stop:
+				return
+			case <-ticker.C:
+				thisPt.refreshHosts(thisPt.clock.Now().Unix())
+			}
+		}
+	}()
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.Close
+//stop resolving the host names of the rules
+func (thisPt *CRuleMatcher) Close() {
+	thisPt.stopOnce.Do(func() { close(thisPt.stop) })
 }
 
 //---------------------------------------------------------------------------------------
-func (thisPt *CRuleMatcher) checkRule(packet *SPacket, rule *sCompiledRule, conversation *SConversationStatus) int {
+func (thisPt *CRuleMatcher) getUsage(rule *sCompiledRule, conversation *SConversationStatus, now int64) (uint64, int64) {
 	usage := conversation.TotalData()
-	duration := conversation.Duration()
+	duration := conversation.Duration(now)
+	activeTime := conversation.ActiveTime
 
 	if rule.Protocol == PROTOCOL_TCP {
 		usage = conversation.TCPStatus.TotalData()
-		duration = conversation.TCPStatus.Duration()
+		duration = conversation.TCPStatus.Duration(now)
+		activeTime = conversation.TCPStatus.ActiveTime
 	} else if rule.Protocol == PROTOCOL_UDP {
 		usage = conversation.UDPStatus.TotalData()
-		duration = conversation.UDPStatus.Duration()
+		duration = conversation.UDPStatus.Duration(now)
+		activeTime = conversation.UDPStatus.ActiveTime
 	}
 
+	//just count the time slices with traffic
+	if rule.TimeMode == RuleTimeModeActive {
+		duration = activeTime
+	}
+	return usage, duration
+}
+
+//---------------------------------------------------------------------------------------
+//return the highest quota threshold that the conversation crossed
+func (thisPt *CRuleMatcher) getQuotaThreshold(rule *sCompiledRule, conversation *SConversationStatus, now int64) int {
+	usage, duration := thisPt.getUsage(rule, conversation, now)
+
+	percent := int64(0)
+	if rule.TimeLimit > 0 {
+		percent = duration * 100 / rule.TimeLimit
+	}
+	if rule.DataLimit > 0 {
+		if dataPercent := int64(usage * 100 / uint64(rule.DataLimit)); dataPercent > percent {
+			percent = dataPercent
+		}
+	}
+	if rule.Pool != nil {
+		if poolPercent := rule.Pool.getPercent(); poolPercent > percent {
+			percent = poolPercent
+		}
+	}
+
+	threshold := 0
+	for _, t := range QuotaEventThresholds {
+		if percent >= int64(t) {
+			threshold = t
+		}
+	}
+	return threshold
+}
+
+//---------------------------------------------------------------------------------------
+//keep the rule, the drops and the crossed quota threshold in the conversation and publish the related events
+func (thisPt *CRuleMatcher) updateConversation(packet *SPacket, rule *sCompiledRule, status *SConversationStatus, exceeded bool, verdict *SVerdict, now int64) {
+	//the drops of the rate limits are counted too, they are not over the quota
+	dropped := verdict.Result == PacketProcessResultDrop || verdict.Result == PacketProcessResultReject
+	threshold := thisPt.getQuotaThreshold(rule, status, now)
+	if status.RuleName == rule.Name && threshold <= status.Threshold && !exceeded && !dropped {
+		return
+	}
+
+	events := []int{}
+	var snapshot SConversationStatus
+	thisPt.conversationTracker.Update(packet, func(conv *SConversationStatus) {
+		if conv.RuleName != rule.Name {
+			conv.RuleName = rule.Name
+			conv.Threshold = 0
+		}
+		if threshold > conv.Threshold {
+			conv.Threshold = threshold
+			events = append(events, ConversationEventQuotaThreshold)
+		}
+		if exceeded {
+			conv.Exceeded++
+		}
+		if dropped {
+			conv.Drops++
+			if conv.Drops == 1 {
+				events = append(events, ConversationEventFirstDrop)
+			}
+		}
+		snapshot = *conv
+	})
+
+	//log only rules just report the first packet over the quota
+	if rule.Action == RuleActionLog && exceeded && snapshot.Exceeded == 1 {
+		log.Printf("rule %s quota exceeded by %s -> %s \n", rule.Name, snapshot.SrcIP, snapshot.DstIP)
+	}
+
+	for _, eventType := range events {
+		event := NewConversationEvent(eventType, &snapshot, now)
+		if eventType == ConversationEventQuotaThreshold {
+			event.Threshold = snapshot.Threshold
+		}
+		thisPt.Publish(event)
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//return true if the conversation exceeded the rule quota
+func (thisPt *CRuleMatcher) checkRule(packet *SPacket, rule *sCompiledRule, conversation *SConversationStatus, now int64) bool {
+	usage, duration := thisPt.getUsage(rule, conversation, now)
+
 	if rule.TimeLimit != -1 && duration >= rule.TimeLimit {
-		return PacketProcessResultDrop
+		return true
 	}
 
 	if rule.DataLimit != -1 && usage >= uint64(rule.DataLimit) {
-		return PacketProcessResultDrop
+		return true
 	}
 
-	return PacketProcessResultOK
+	return false
 }
 
 //---------------------------------------------------------------------------------------
-func (thisPt *CRuleMatcher) Match(packet *SPacket, timeStamp int64) (int, string) {
+//convert the action of a rule to the packet verdict
+func (thisPt *CRuleMatcher) applyAction(rule *sCompiledRule, conversation *SConversationStatus, timeStamp int64) SVerdict {
+	verdict := SVerdict{RuleName: rule.Name}
+
+	switch rule.Action {
+	case RuleActionDrop:
+		verdict.Result = PacketProcessResultDrop
+	case RuleActionReject:
+		verdict.Result = PacketProcessResultReject
+	case RuleActionMark:
+		verdict.Result = PacketProcessResultMark
+		verdict.Mark = rule.Mark
+	case RuleActionThrottle:
+		//drop the packets with the probability of the extra rate to hold the conversation at the target rate
+		rate := conversation.CurrentRate(timeStamp)
+		if rule.Protocol == PROTOCOL_TCP {
+			rate = conversation.TCPStatus.CurrentRate(timeStamp)
+		} else if rule.Protocol == PROTOCOL_UDP {
+			rate = conversation.UDPStatus.CurrentRate(timeStamp)
+		}
+		if rate > float64(rule.Throttle) && rand.Float64() < 1-float64(rule.Throttle)/rate {
+			verdict.Result = PacketProcessResultDrop
+		}
+	}
+	return verdict
+}
+
+//---------------------------------------------------------------------------------------
+//charge the packet to the token bucket of the subscriber
+func (thisPt *CRuleMatcher) checkRateLimit(packet *SPacket, rule *sCompiledRule, subscriber net.IP, conversation *SConversationStatus, now time.Time) SVerdict {
+	verdict := SVerdict{Result: PacketProcessResultOK, RuleName: rule.Name}
+
+	//some rules just limit the rate after some usage
+	if usage, _ := thisPt.getUsage(rule, conversation, now.Unix()); rule.RateAfter != -1 && usage <= uint64(rule.RateAfter) {
+		return verdict
+	}
+
+	maxDelay := time.Duration(0)
+	if rule.RateDelay {
+		maxDelay = MaxRateLimitDelay
+	}
+
+	thisPt.conversationTracker.UpdateSubscriber(subscriber, func(status *SSubscriberStatus) {
+		bucket, fnd := status.Buckets[rule.Name]
+		if !fnd {
+			bucket = CreateTokenBucket(float64(rule.RateLimit)/8, float64(rule.RateBurst))
+			status.Buckets[rule.Name] = bucket
+		}
+
+		//the rule may be changed
+		bucket.Rate = float64(rule.RateLimit) / 8
+		bucket.Burst = float64(rule.RateBurst)
+
+		if ok, delay := bucket.Take(int(packet.DataSize), now.UnixNano(), maxDelay); !ok {
+			verdict.Result = PacketProcessResultDrop
+		} else {
+			verdict.Delay = delay
+		}
+	})
+	return verdict
+}
+
+//---------------------------------------------------------------------------------------
+//charge the packet to the pool of a rule. a packet is charged once to each pool, even if several rules share the pool.
+//returns false if the pool is exhausted
+func (thisPt *CRuleMatcher) chargePool(pool *sQuotaPool, packet *SPacket, charged *[]*sQuotaPool) bool {
+	for _, p := range *charged {
+		if p == pool {
+			return true
+		}
+	}
+	if !pool.charge(int64(packet.DataSize)) {
+		return false
+	}
+	*charged = append(*charged, pool)
+	return true
+}
+
+//---------------------------------------------------------------------------------------
+//order the candidate rules, ordered by their precedence, for the evaluation mode
+func (thisPt *CRuleMatcher) orderRules(rules []sCompiledRule) []sCompiledRule {
+	if thisPt.evaluationMode == RuleEvaluationPriority || thisPt.evaluationMode == RuleEvaluationAll {
+		sort.SliceStable(rules, func(i, j int) bool { return rules[i].Priority < rules[j].Priority })
+	}
+	return rules
+}
+
+//---------------------------------------------------------------------------------------
+//select the rules to evaluate from the ordered rules. the list could be shared, so it is not changed
+func (thisPt *CRuleMatcher) selectRules(rules []sCompiledRule, now time.Time) []sCompiledRule {
+	if thisPt.evaluationMode == RuleEvaluationAll {
+		return filterActiveRules(rules, now)
+	}
+
+	//just the first active rule
+	for i := range rules {
+		if rules[i].Schedule.active(now) {
+			return rules[i : i+1]
+		}
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+//return the subscriber of a conversation, its MAC address and the remote endpoint. the subscriber is the endpoint in
+//the subscriber networks. the source of the conversation is the subscriber if the networks are not defined or they
+//have both or none of the endpoints
+func (thisPt *CRuleMatcher) getSubscriber(status *SConversationStatus) (net.IP, net.HardwareAddr, net.IP) {
+	contains := func(ip net.IP) bool {
+		for _, network := range thisPt.subscriberNetworks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(thisPt.subscriberNetworks) > 0 && !contains(status.SrcIP) && contains(status.DstIP) {
+		return status.DstIP, nil, status.SrcIP
+	}
+	return status.SrcIP, status.SrcMAC, status.DstIP
+}
+
+//---------------------------------------------------------------------------------------
+//return the ordered candidate rules of a conversation. the rules are cached in the conversation until the rules reload
+func (thisPt *CRuleMatcher) getRules(packet *SPacket, remote net.IP, subscriber net.IP, mac net.HardwareAddr, status *SConversationStatus) []sCompiledRule {
+	slot := getRuleCacheSlot(uint16(packet.Protocol))
+	if cache := status.ruleCache[slot]; cache != nil && cache.generation == thisPt.ruleSet.generation && !thisPt.disableRuleCache {
+		return cache.rules
+	}
+
+	cache := &sRuleCache{generation: thisPt.ruleSet.generation}
+	cache.rules = thisPt.orderRules(thisPt.ruleSet.findCandidates(remote, subscriber, mac, uint16(packet.Protocol), packet.IpVersion))
+	if !thisPt.disableRuleCache {
+		thisPt.conversationTracker.Update(packet, func(conv *SConversationStatus) {
+			conv.ruleCache[slot] = cache
+		})
+	}
+	return cache.rules
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CRuleMatcher) Match(packet *SPacket, timeStamp int64) SVerdict {
 
 	thisPt.accessLock.RLock()
 	defer thisPt.accessLock.RUnlock()
 
+	//the quotas and the schedules are checked against the current time, the time stamp is the packet time
+	now := thisPt.clock.Now()
+	if timeStamp == 0 {
+		timeStamp = now.Unix()
+	}
+
+	//the exempt networks and the deny rules are checked before tracking the conversation
+	if thisPt.ruleSet.isExempt(packet.SIp) || thisPt.ruleSet.isExempt(packet.DIp) {
+		return SVerdict{Result: PacketProcessResultOK}
+	}
+	if fnd, rule := thisPt.ruleSet.findDenyRule(packet, now); fnd {
+		result := PacketProcessResultDrop
+		if rule.Action == RuleActionReject {
+			result = PacketProcessResultReject
+		}
+		return SVerdict{Result: result, RuleName: rule.Name, Rules: []string{rule.Name}}
+	}
+
 	//get active conversation
 	fnd, status := thisPt.conversationTracker.GetStatus(packet, timeStamp)
 	if !fnd {
 		//can not find any conversation, usually because the conversation table is full
-		return PacketProcessResultOK, ""
+		if thisPt.conversationTracker.GetTableFullPolicy() == ConversationTableFullFailClosed {
+			return SVerdict{Result: PacketProcessResultDrop}
+		}
+		return SVerdict{Result: PacketProcessResultOK}
+	}
+
+	//find active rules. the destinations of the rules match the remote endpoint
+	subscriber, mac, remote := thisPt.getSubscriber(&status)
+	rules := thisPt.selectRules(thisPt.getRules(packet, remote, subscriber, mac, &status), now)
+	if len(rules) == 0 {
+		return SVerdict{Result: PacketProcessResultOK}
+	}
+
+	//check the rules against the conversation info. the first rule that does not pass decides the verdict
+	verdict := SVerdict{Result: PacketProcessResultOK}
+	primary := -1
+	primaryExceeded := false
+	primaryThreshold := -1
+	charged := []*sQuotaPool{}
+	for i := range rules {
+		rule := &rules[i]
+		verdict.Rules = append(verdict.Rules, rule.Name)
+
+		//allow rules pass the packet without checking the other rules
+		if rule.Type == RuleTypeAllow {
+			primary = i
+			primaryExceeded = false
+			break
+		}
+
+		ruleVerdict := SVerdict{Result: PacketProcessResultOK, RuleName: rule.Name}
+		exceeded := thisPt.checkRule(packet, rule, &status, now.Unix())
+		if !exceeded && rule.Pool != nil {
+			exceeded = !thisPt.chargePool(rule.Pool, packet, &charged)
+		}
+		if exceeded {
+			ruleVerdict = thisPt.applyAction(rule, &status, timeStamp)
+		}
+
+		//check the rate limit of the accepted packets
+		if rule.RateLimit > 0 && ruleVerdict.Result == PacketProcessResultOK {
+			ruleVerdict = thisPt.checkRateLimit(packet, rule, subscriber, &status, now)
+		}
+		if ruleVerdict.Delay > verdict.Delay {
+			verdict.Delay = ruleVerdict.Delay
+		}
+
+		if ruleVerdict.Result != PacketProcessResultOK {
+			verdict.Result = ruleVerdict.Result
+			verdict.Mark = ruleVerdict.Mark
+			primary = i
+			primaryExceeded = exceeded
+			break
+		}
+
+		//the conversation keeps the rule closest to its quota
+		if threshold := thisPt.getQuotaThreshold(rule, &status, now.Unix()); threshold > primaryThreshold {
+			primary = i
+			primaryExceeded = exceeded
+			primaryThreshold = threshold
+		}
 	}
 
-	/*
-		To improve the performance of the system it is possible to save the rule info into the conversation.
-		This will reduce the per-packet rule matching overhead.
-		to keep the solution simple I ignored this mechanism
-	*/
+	//the pools are charged when their rules pass, the later rules could still block the packet
+	if verdict.Result == PacketProcessResultDrop || verdict.Result == PacketProcessResultReject {
+		for _, pool := range charged {
+			pool.refund(int64(packet.DataSize))
+		}
+	}
 
-	//find active rule
-	ip := packet.DIp
-	if status.Direction(packet) == ConversationDirectionReceive {
-		ip = packet.SIp
+	verdict.RuleName = rules[primary].Name
+	thisPt.updateConversation(packet, &rules[primary], &status, primaryExceeded, &verdict, now.Unix())
+	return verdict
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.DumpPools
+func (thisPt *CRuleMatcher) DumpPools() string {
+	thisPt.accessLock.RLock()
+	defer thisPt.accessLock.RUnlock()
+
+	out := []SQuotaPoolStatus{}
+	for _, pool := range thisPt.pools {
+		out = append(out, pool.getStatus())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+
+	data, _ := json.Marshal(out)
+	return string(data)
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.TopUpPool
+func (thisPt *CRuleMatcher) TopUpPool(name string, size string) error {
+	data, err := parseSize(size, thisPt.sizeUnits)
+	if err != nil {
+		return err
+	}
+
+	thisPt.accessLock.RLock()
+	defer thisPt.accessLock.RUnlock()
+	pool, fnd := thisPt.pools[name]
+	if !fnd {
+		return fmt.Errorf("unknown pool %s", name)
 	}
+	pool.addTopUp(data)
+	return nil
+}
 
-	fnd, rule := thisPt.findRule(ip, uint16(packet.Protocol))
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.ResetPool
+func (thisPt *CRuleMatcher) ResetPool(name string) error {
+	thisPt.accessLock.RLock()
+	defer thisPt.accessLock.RUnlock()
+	pool, fnd := thisPt.pools[name]
 	if !fnd {
-		return PacketProcessResultOK, ""
+		return fmt.Errorf("unknown pool %s", name)
+	}
+	pool.reset()
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.Reload
+func (thisPt *CRuleMatcher) Reload() error {
+	//the current rules stay active on any error
+	pinned := uint64(0)
+	thisPt.reposLock.Lock()
+	err := thisPt.ruleRepos.Reload()
+	thisPt.reposLock.Unlock()
+	if err == nil {
+		pinned, err = thisPt.loadRules()
+	}
+
+	thisPt.reloadStatusLock.Lock()
+	defer thisPt.reloadStatusLock.Unlock()
+	now := thisPt.clock.Now().Unix()
+	if err != nil {
+		thisPt.reloadStatus.Failures++
+		thisPt.reloadStatus.LastError = err.Error()
+		thisPt.reloadStatus.LastErrorTime = now
+		log.Printf("can not reload the rules, the current rules are kept, %v \n", err)
+		return err
+	}
+	thisPt.reloadStatus.Reloads++
+	thisPt.reloadStatus.LastReload = now
+	if pinned != 0 {
+		log.Printf("rules reloaded, the pinned rules version %d stays active \n", pinned)
+		return nil
+	}
+	log.Printf("rules reloaded successfully \n")
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.DumpRules
+func (thisPt *CRuleMatcher) DumpRules() string {
+	thisPt.accessLock.RLock()
+	defer thisPt.accessLock.RUnlock()
+
+	out, _ := json.Marshal(thisPt.activeRules)
+	return string(out)
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.DumpReloadStatus
+func (thisPt *CRuleMatcher) DumpReloadStatus() string {
+	thisPt.reloadStatusLock.Lock()
+	status := thisPt.reloadStatus
+	thisPt.reloadStatusLock.Unlock()
+
+	history := thisPt.getHistory()
+	status.Version = history.getActive()
+	status.Pinned = history.getPinned() != 0
+
+	out, _ := json.Marshal(status)
+	return string(out)
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.SetSubscriberNetworks
+func (thisPt *CRuleMatcher) SetSubscriberNetworks(networks []string) error {
+	subscriberNetworks := []*net.IPNet{}
+	for _, item := range networks {
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return fmt.Errorf("invalid subscriber network %s", item)
+		}
+		subscriberNetworks = append(subscriberNetworks, network)
+	}
+
+	thisPt.reloadLock.Lock()
+	defer thisPt.reloadLock.Unlock()
+
+	//the cached rules of the conversations depend on their subscribers
+	thisPt.generation++
+	thisPt.accessLock.Lock()
+	thisPt.subscriberNetworks = subscriberNetworks
+	thisPt.ruleSet.generation = thisPt.generation
+	thisPt.accessLock.Unlock()
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.SetSourceMACAvailable
+func (thisPt *CRuleMatcher) SetSourceMACAvailable(available bool) error {
+	thisPt.reposLock.Lock()
+	defer thisPt.reposLock.Unlock()
+	thisPt.reloadLock.Lock()
+	defer thisPt.reloadLock.Unlock()
+
+	if thisPt.disableSourceMAC == !available {
+		return nil
+	}
+
+	//the active rules are compiled again, the MAC addresses are rejected if the packets have no source MAC
+	thisPt.disableSourceMAC = !available
+	if err := thisPt.compileRules(&thisPt.activeRules); err != nil {
+		thisPt.disableSourceMAC = available
+		return err
 	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.SetRuleHistory
+func (thisPt *CRuleMatcher) SetRuleHistory(dir string, size int) error {
+	thisPt.reposLock.Lock()
+	defer thisPt.reposLock.Unlock()
+	thisPt.reloadLock.Lock()
+	defer thisPt.reloadLock.Unlock()
+
+	//the versions of the disk replace the versions in the memory, the active rules are added to them
+	history := createRuleHistory(size)
+	if len(dir) > 0 {
+		if err := history.load(dir, size); err != nil {
+			return err
+		}
+	}
+	history.add(thisPt.activeRules, thisPt.clock.Now().Unix())
+
+	//the version pinned before the restart replaces the rules of the repository
+	if pinned := history.getPinned(); pinned != 0 {
+		version, err := history.get(pinned)
+		if err == nil {
+			rules := version.Rules
+			err = thisPt.compileRules(&rules)
+		}
+		if err != nil {
+			log.Printf("can not activate the pinned rules version %d, the rules of the repository are kept, %v \n", pinned, err)
+			history.pin(0)
+		} else {
+			history.pin(pinned)
+			log.Printf("pinned rules version %d activated \n", pinned)
+		}
+	}
+
+	thisPt.accessLock.Lock()
+	thisPt.history = history
+	thisPt.accessLock.Unlock()
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CRuleMatcher) getHistory() *cRuleHistory {
+	thisPt.accessLock.RLock()
+	defer thisPt.accessLock.RUnlock()
+	return thisPt.history
+}
 
-	//check rule against the conversation info
-	return thisPt.checkRule(packet, &rule, &status), rule.Name
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.DumpRuleVersions
+func (thisPt *CRuleMatcher) DumpRuleVersions() string {
+	out, _ := json.Marshal(thisPt.getHistory().dump())
+	return string(out)
 }
 
 //---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.DiffRuleVersions
+//to is the active version if it is 0
+func (thisPt *CRuleMatcher) DiffRuleVersions(from uint64, to uint64) (string, error) {
+	history := thisPt.getHistory()
+	if to == 0 {
+		to = history.getActive()
+	}
+	fromVersion, err := history.get(from)
+	if err != nil {
+		return "", err
+	}
+	toVersion, err := history.get(to)
+	if err != nil {
+		return "", err
+	}
+	out, _ := json.Marshal(diffRuleSets(fromVersion, toVersion))
+	return string(out), nil
+}
 
-func CreateMatcher(ruleRepos IRuleRepository, conversation IConversationTracker) IRuleMatcher {
+//---------------------------------------------------------------------------------------
+// implement  IRuleMatcher.ActivateRuleVersion
+//the activated version is pinned, the reloads do not replace it. 0 activates the rules of the repository again
+func (thisPt *CRuleMatcher) ActivateRuleVersion(generation uint64) error {
+	thisPt.reposLock.Lock()
+	defer thisPt.reposLock.Unlock()
+	thisPt.reloadLock.Lock()
+	defer thisPt.reloadLock.Unlock()
+
+	history := thisPt.getHistory()
+	if generation == 0 {
+		if err := thisPt.compileRules(thisPt.ruleRepos); err != nil {
+			return err
+		}
+		history.pin(0)
+		history.add(thisPt.activeRules, thisPt.clock.Now().Unix())
+		log.Printf("rules of the repository activated \n")
+		return nil
+	}
+
+	//the rules are compiled again, so the pools keep their usage and the host names are resolved
+	version, err := history.get(generation)
+	if err != nil {
+		return err
+	}
+	rules := version.Rules
+	if err := thisPt.compileRules(&rules); err != nil {
+		return err
+	}
+	history.pin(generation)
+	log.Printf("rules version %d activated and pinned \n", generation)
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+//the system resolver and the system clock are used if resolver or clock is nil. sizeUnits is SizeUnitsBinary or
+//SizeUnitsSI
+func CreateMatcher(ruleRepos IRuleRepository, conversation IConversationTracker, evaluationMode int, sizeUnits int, resolver IResolver, clock IClock) (IRuleMatcher, error) {
 	matcher := new(CRuleMatcher)
-	matcher.ruleParseRegx = regexp.MustCompile(`(?m)(\d+)(\w{1,2})`)
+	matcher.evaluationMode = evaluationMode
+	matcher.sizeUnits = sizeUnits
 	matcher.conversationTracker = conversation
 	matcher.ruleRepos = ruleRepos
-	//just IPV4
-	matcher.ipTri.Init(4)
+	matcher.resolver = resolver
+	matcher.clock = clock
+	if matcher.clock == nil {
+		matcher.clock = CSystemClock{}
+	}
+	if matcher.resolver == nil {
+		matcher.resolver = CreateSystemResolver()
+	}
+	matcher.history = createRuleHistory(DefaultRuleHistorySize)
+	matcher.stop = make(chan struct{})
 
-	if err := matcher.loadRules(); err != nil {
-		log.Fatalln(err)
+	if _, err := matcher.loadRules(); err != nil {
+		return nil, err
 	}
-	return matcher
+
+	//keep the host names up to date
+	matcher.startResolveProcess()
+	return matcher, nil
 }
@@ -1,11 +1,44 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
+func createTestMatcher(t *testing.T, rules string, conv IConversationTracker, evaluationMode int, resolver IResolver, clock IClock) IRuleMatcher {
+	repos, err := CreateJsonRuleRepositoryFromStr(rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher, err := CreateMatcher(repos, conv, evaluationMode, SizeUnitsBinary, resolver, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(matcher.Close)
+	return matcher
+}
+
+//return the error of loading the rules. the resolve process is not started for the invalid rules
+func compileTestRules(rules string) error {
+	repos, err := CreateJsonRuleRepositoryFromStr(rules)
+	if err != nil {
+		return err
+	}
+	matcher, err := CreateMatcher(repos, nil, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil)
+	if err == nil {
+		matcher.Close()
+	}
+	return err
+}
+
 func TestMatcher(t *testing.T) {
 
 	//create rule repos
@@ -46,13 +79,12 @@ func TestMatcher(t *testing.T) {
 	rpacket := spacket
 	rpacket.SIp, rpacket.DIp = rpacket.DIp, rpacket.SIp
 
-	repos := CreateJsonRuleRepositoryFromStr(rules)
-	conv := CreateConversationTracker(3600, 2048)
-	matcher := CreateMatcher(repos, conv)
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, nil)
 
 	checkSenario := func(packet *SPacket, policyName string, result int, timeStamp int64) {
-		res, name := matcher.Match(packet, timeStamp)
-		if name != policyName || res != result {
+		verdict := matcher.Match(packet, timeStamp)
+		if verdict.RuleName != policyName || verdict.Result != result {
 			t.Fatal("match failed")
 		}
 	}
@@ -79,3 +111,1081 @@ func TestMatcher(t *testing.T) {
 	checkSenario(&spacket, "default", PacketProcessResultOK, 0)
 
 }
+
+func TestMatcherActiveTime(t *testing.T) {
+
+	rules := `
+	{
+		"rules":[
+			{
+				"name":"active",
+				"destination":"192.168.4.0/24",
+				"usage_time":"3m",
+				"usage_time_mode":"active",
+				"protocol" : "any"
+			}
+		]
+	}
+	`
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("192.168.4.2").To4()
+	packet.Protocol = PROTOCOL_TCP
+	packet.IpVersion = 4
+	packet.DataSize = 100
+
+	conv := CreateConversationTracker(3600*24, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, nil)
+
+	//one packet per hour just uses one time slice per hour
+	start := time.Now().Unix() - 3*3600
+	expected := []int{PacketProcessResultOK, PacketProcessResultOK, PacketProcessResultDrop}
+	for i, result := range expected {
+		if verdict := matcher.Match(&packet, start+int64(i)*3600); verdict.Result != result || verdict.RuleName != "active" {
+			t.Fatalf("match failed at step %d", i)
+		}
+	}
+
+	//with two minutes slices the second packet exceeds the quota
+	conv = CreateConversationTracker(3600*24, 2048, ConversationTableFullEvict, nil)
+	conv.SetActiveTimeSlice(120)
+	matcher = createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, nil)
+	expected = []int{PacketProcessResultOK, PacketProcessResultDrop}
+	for i, result := range expected {
+		if verdict := matcher.Match(&packet, start+int64(i)*3600); verdict.Result != result {
+			t.Fatalf("match failed at step %d of the two minutes slices", i)
+		}
+	}
+}
+
+func TestMatcherIPv6(t *testing.T) {
+
+	rules := `
+	{
+		"rules":[
+			{
+				"name":"v6net",
+				"destination":"2001:db8:1::/48",
+				"usage_size":"2kb",
+				"protocol" : "any"
+			},
+			{
+				"name":"v6host",
+				"destination":"2001:db8:2::1",
+				"usage_time":"1h",
+				"protocol" : "tcp"
+			},
+			{
+				"name":"v6default",
+				"destination":"::/0",
+				"usage_size":"256mb",
+				"protocol" : "udp"
+			},
+			{
+				"name":"v4default",
+				"destination":"0.0.0.0/0",
+				"usage_size":"256mb",
+				"protocol" : "any"
+			},
+			{
+				"name":"v4mapped",
+				"destination":"::ffff:10.0.0.0/104",
+				"usage_size":"256mb",
+				"protocol" : "any"
+			}
+		]
+	}
+	`
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("2001:db8:ffff::10")
+	packet.DIp = net.ParseIP("2001:db8:1:2::1")
+	packet.Protocol = PROTOCOL_TCP
+	packet.IpVersion = 6
+	packet.DataSize = 1500
+
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, nil)
+
+	checkSenario := func(packet *SPacket, policyName string, result int, timeStamp int64) {
+		verdict := matcher.Match(packet, timeStamp)
+		if verdict.RuleName != policyName || verdict.Result != result {
+			t.Fatalf("match failed, %s %d", verdict.RuleName, verdict.Result)
+		}
+	}
+
+	//prefix rule
+	checkSenario(&packet, "v6net", PacketProcessResultOK, 0)
+	checkSenario(&packet, "v6net", PacketProcessResultDrop, 0)
+
+	//host rule (/128)
+	packet.DIp = net.ParseIP("2001:db8:2::1")
+	checkSenario(&packet, "v6host", PacketProcessResultDrop, time.Now().Unix()-3700)
+
+	//the IPv6 default network
+	packet.DIp = net.ParseIP("2001:db8:3::1")
+	packet.Protocol = PROTOCOL_UDP
+	checkSenario(&packet, "v6default", PacketProcessResultOK, 0)
+
+	//the IPv4 default network should not match IPv6 traffic
+	packet.Protocol = PROTOCOL_TCP
+	checkSenario(&packet, "", PacketProcessResultOK, 0)
+
+	//the IPv4-mapped prefixes are IPv6 networks, they do not match IPv4 traffic
+	packet.DIp = net.ParseIP("::ffff:10.0.0.1")
+	checkSenario(&packet, "v4mapped", PacketProcessResultOK, 0)
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("10.0.0.1").To4()
+	packet.IpVersion = 4
+	checkSenario(&packet, "v4default", PacketProcessResultOK, 0)
+}
+
+type cFakeResolver struct {
+	lock  sync.Mutex
+	hosts map[string][]net.IP
+	ttl   time.Duration
+}
+
+func (thisPt *cFakeResolver) Resolve(host string) ([]net.IP, time.Duration, error) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	if ips, fnd := thisPt.hosts[host]; fnd {
+		return ips, thisPt.ttl, nil
+	}
+	return nil, 0, errors.New("not found")
+}
+
+func (thisPt *cFakeResolver) set(host string, ips ...string) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	thisPt.hosts[host] = []net.IP{}
+	for _, ip := range ips {
+		thisPt.hosts[host] = append(thisPt.hosts[host], net.ParseIP(ip))
+	}
+}
+
+func TestMatcherHostRefresh(t *testing.T) {
+
+	rules := `
+	{
+		"rules":[
+			{
+				"name":"cdn",
+				"destination":"cdn.example.com",
+				"usage_size":"100mb",
+				"protocol" : "any"
+			}
+		]
+	}
+	`
+	resolver := &cFakeResolver{hosts: map[string][]net.IP{}, ttl: 60 * time.Second}
+	resolver.set("cdn.example.com", "10.1.1.1", "10.1.1.2", "2001:db8::1")
+
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, resolver, nil)
+
+	checkSenario := func(dst string, policyName string) {
+		packet := SPacket{}
+		packet.SIp = net.ParseIP("192.168.0.1").To4()
+		packet.DIp = net.ParseIP(dst).To4()
+		packet.IpVersion = 4
+		if packet.DIp == nil {
+			packet.SIp = net.ParseIP("2001:db8:ffff::1")
+			packet.DIp = net.ParseIP(dst)
+			packet.IpVersion = 6
+		}
+		packet.Protocol = PROTOCOL_TCP
+		packet.DataSize = 100
+		if verdict := matcher.Match(&packet, 0); verdict.RuleName != policyName {
+			t.Fatalf("match failed for %s", dst)
+		}
+	}
+
+	//all the addresses should match
+	checkSenario("10.1.1.1", "cdn")
+	checkSenario("10.1.1.2", "cdn")
+	checkSenario("2001:db8::1", "cdn")
+	checkSenario("10.1.1.3", "")
+
+	//not refreshed before the TTL
+	resolver.set("cdn.example.com", "10.1.1.3")
+	matcherInt := matcher.(*CRuleMatcher)
+	matcherInt.refreshHosts(time.Now().Unix() + 10)
+	checkSenario("10.1.1.1", "cdn")
+
+	//refreshed after the TTL
+	matcherInt.refreshHosts(time.Now().Unix() + 61)
+	checkSenario("10.1.1.3", "cdn")
+	checkSenario("10.1.1.1", "")
+	checkSenario("2001:db8::1", "")
+}
+
+func TestMatcherSources(t *testing.T) {
+
+	rules := `
+	{
+		"groups":[
+			{
+				"name":"kids",
+				"members":["10.20.5.10", "aa:bb:cc:dd:ee:ff"]
+			}
+		],
+		"rules":[
+			{
+				"name":"guest",
+				"sources":["10.20.0.0/16"],
+				"destination":"0.0.0.0/0",
+				"usage_size":"1gb",
+				"protocol" : "any"
+			},
+			{
+				"name":"kids",
+				"sources":["kids"],
+				"destination":"0.0.0.0/0",
+				"usage_time":"2h",
+				"protocol" : "any"
+			},
+			{
+				"name":"everyone",
+				"destination":"0.0.0.0/0",
+				"usage_size":"10gb",
+				"protocol" : "any"
+			},
+			{
+				"name":"video",
+				"destination":"1.1.1.0/24",
+				"usage_size":"1mb",
+				"protocol" : "tcp"
+			},
+			{
+				"name":"guest-video",
+				"sources":["10.20.0.0/16"],
+				"destination":"1.1.1.0/24",
+				"usage_size":"1mb",
+				"protocol" : "any"
+			}
+		]
+	}
+	`
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, nil)
+
+	checkSenario := func(src string, mac string, dst string, policyName string) {
+		packet := SPacket{}
+		packet.SIp = net.ParseIP(src).To4()
+		packet.DIp = net.ParseIP(dst).To4()
+		packet.SrcMAC, _ = net.ParseMAC(mac)
+		packet.IpVersion = 4
+		packet.Protocol = PROTOCOL_TCP
+		packet.DataSize = 100
+		if verdict := matcher.Match(&packet, 0); verdict.RuleName != policyName {
+			t.Fatalf("match failed for %s -> %s, %s", src, dst, verdict.RuleName)
+		}
+
+		//the subscriber is the conversation source in both directions
+		packet.SIp, packet.DIp = packet.DIp, packet.SIp
+		packet.SrcMAC = nil
+		if verdict := matcher.Match(&packet, 0); verdict.RuleName != policyName {
+			t.Fatalf("match failed for %s <- %s, %s", src, dst, verdict.RuleName)
+		}
+	}
+
+	checkSenario("10.20.1.1", "", "8.8.8.8", "guest")
+	checkSenario("10.30.1.1", "", "8.8.8.8", "everyone")
+
+	//group members are more specific than the networks
+	checkSenario("10.20.5.10", "", "8.8.8.8", "kids")
+	checkSenario("192.168.1.20", "aa:bb:cc:dd:ee:ff", "8.8.8.8", "kids")
+
+	//the destination prefix comes first, then the source
+	checkSenario("10.20.1.1", "", "1.1.1.1", "guest-video")
+	checkSenario("10.30.1.1", "", "1.1.1.1", "video")
+
+	//unknown groups are invalid
+	if err := compileTestRules(`{"rules":[{"name":"x","sources":["unknown"],"destination":"0.0.0.0/0","protocol":"any"}]}`); err == nil {
+		t.Fatal("unknown group should be rejected")
+	}
+
+	//the packets of the local mode have no source MAC, the active rules are kept
+	if err := matcher.SetSourceMACAvailable(false); err == nil {
+		t.Fatal("MAC address should be rejected")
+	}
+	checkSenario("192.168.1.20", "aa:bb:cc:dd:ee:ff", "8.8.8.8", "kids")
+
+	other := createTestMatcher(t, `{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any"}]}`, nil, RuleEvaluationLongestPrefix, nil, nil)
+	if err := other.SetSourceMACAvailable(false); err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{
+		`{"rules":[{"name":"x","sources":["aa:bb:cc:dd:ee:ff"],"destination":"0.0.0.0/0","protocol":"any"}]}`,
+		`{"groups":[{"name":"g","members":["aa:bb:cc:dd:ee:ff"]}]}`,
+	} {
+		repos, _ := CreateJsonRuleRepositoryFromStr(item)
+		if err := other.(*CRuleMatcher).compileRules(repos); err == nil {
+			t.Fatalf("MAC address should be rejected, %s", item)
+		}
+	}
+}
+
+func TestMatcherActions(t *testing.T) {
+
+	rules := `
+	{
+		"rules":[
+			{
+				"name":"reject",
+				"destination":"10.0.1.0/24",
+				"usage_size":"1kb",
+				"protocol" : "any",
+				"action" : "reject"
+			},
+			{
+				"name":"mark",
+				"destination":"10.0.2.0/24",
+				"usage_size":"1kb",
+				"protocol" : "any",
+				"action" : "mark",
+				"mark" : 16
+			},
+			{
+				"name":"log",
+				"destination":"10.0.3.0/24",
+				"usage_size":"1kb",
+				"protocol" : "any",
+				"action" : "log"
+			},
+			{
+				"name":"throttle",
+				"destination":"10.0.4.0/24",
+				"usage_size":"1kb",
+				"protocol" : "any",
+				"action" : "throttle",
+				"throttle_rate" : "8kbit"
+			}
+		]
+	}
+	`
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, nil)
+
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_UDP
+	packet.DataSize = 1000
+
+	checkSenario := func(dst string, result int, mark uint32) {
+		packet.DIp = net.ParseIP(dst).To4()
+		if verdict := matcher.Match(&packet, 0); verdict.Result != PacketProcessResultOK {
+			t.Fatalf("match failed for %s", dst)
+		}
+		if verdict := matcher.Match(&packet, 0); verdict.Result != result || verdict.Mark != mark {
+			t.Fatalf("match failed for %s", dst)
+		}
+	}
+
+	checkSenario("10.0.1.1", PacketProcessResultReject, 0)
+	checkSenario("10.0.2.1", PacketProcessResultMark, 16)
+	checkSenario("10.0.3.1", PacketProcessResultOK, 0)
+
+	//10 packets per second, 80kbps. about 90% of the packets should be dropped
+	packet.DIp = net.ParseIP("10.0.4.1").To4()
+	start := time.Now().Unix() - 100
+	drops := 0
+	for i := int64(0); i < 200; i++ {
+		if verdict := matcher.Match(&packet, start+i/10); verdict.Result == PacketProcessResultDrop && i >= 100 {
+			drops++
+		}
+	}
+	if drops < 70 || drops == 100 {
+		t.Fatalf("invalid throttle drops %d", drops)
+	}
+
+	//mark action needs a mark
+	if err := compileTestRules(`{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","action":"mark"}]}`); err == nil {
+		t.Fatal("mark rule without mark should be rejected")
+	}
+}
+
+type cFakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (thisPt *cFakeClock) Now() time.Time {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	return thisPt.now
+}
+
+func (thisPt *cFakeClock) Set(now time.Time) {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	thisPt.now = now
+}
+
+func TestMatcherRateLimit(t *testing.T) {
+	rules := `
+	{
+		"rules":[
+			{
+				"name":"drop",
+				"destination":"10.0.1.0/24",
+				"protocol" : "any",
+				"rate_limit" : "80kbit",
+				"rate_limit_burst" : "2kb"
+			},
+			{
+				"name":"delay",
+				"destination":"10.0.2.0/24",
+				"protocol" : "any",
+				"rate_limit" : "80kbit",
+				"rate_limit_burst" : "1500b",
+				"rate_limit_action" : "delay"
+			},
+			{
+				"name":"after",
+				"destination":"10.0.3.0/24",
+				"protocol" : "any",
+				"rate_limit" : "8kbit",
+				"rate_limit_after" : "2kb"
+			}
+		]
+	}
+	`
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	clock := &cFakeClock{}
+	clock.Set(time.Now())
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, clock)
+
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_UDP
+	packet.DataSize = 1024
+
+	//10KB per second and 2KB burst
+	packet.DIp = net.ParseIP("10.0.1.1").To4()
+	for i, result := range []int{PacketProcessResultOK, PacketProcessResultOK, PacketProcessResultDrop} {
+		if verdict := matcher.Match(&packet, 0); verdict.Result != result {
+			t.Fatalf("invalid rate limit result for packet %d", i)
+		}
+	}
+	if _, status := conv.GetStatus(&packet, clock.Now().Unix()); status.Drops != 1 {
+		t.Fatal("rate limit drops should be counted")
+	}
+	clock.Set(clock.Now().Add(110 * time.Millisecond))
+	if verdict := matcher.Match(&packet, 0); verdict.Result != PacketProcessResultOK {
+		t.Fatal("tokens should be refilled")
+	}
+
+	//the answers of the remote host are charged to the bucket of the subscriber
+	answer := packet
+	answer.SIp, answer.DIp = packet.DIp, packet.SIp
+	if verdict := matcher.Match(&answer, 0); verdict.Result != PacketProcessResultDrop {
+		t.Fatal("answer should use the bucket of the subscriber")
+	}
+
+	//the second packet should wait for about 100ms, the third one is dropped
+	packet.DIp = net.ParseIP("10.0.2.1").To4()
+	if verdict := matcher.Match(&packet, 0); verdict.Result != PacketProcessResultOK || verdict.Delay != 0 {
+		t.Fatal("first packet should pass")
+	}
+	clock.Set(clock.Now().Add(10 * time.Millisecond))
+	if verdict := matcher.Match(&packet, 0); verdict.Result != PacketProcessResultOK || verdict.Delay == 0 || verdict.Delay > MaxRateLimitDelay {
+		t.Fatal("second packet should be delayed")
+	}
+	if verdict := matcher.Match(&packet, 0); verdict.Result != PacketProcessResultDrop {
+		t.Fatal("third packet should be dropped")
+	}
+
+	//the rate limit starts after 2KB, the burst is one MTU at least
+	packet.DIp = net.ParseIP("10.0.3.1").To4()
+	for i := 0; i < 3; i++ {
+		if verdict := matcher.Match(&packet, 0); verdict.Result != PacketProcessResultOK {
+			t.Fatal("packets before the limit should pass")
+		}
+	}
+	if verdict := matcher.Match(&packet, 0); verdict.Result != PacketProcessResultDrop {
+		t.Fatal("packets after the limit should be dropped")
+	}
+
+	//the subscriber is the destination of the conversations started by the remote hosts
+	if err := matcher.SetSubscriberNetworks([]string{"192.168.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	incoming := packet
+	incoming.SIp, incoming.DIp = net.ParseIP("10.0.1.2").To4(), net.ParseIP("192.168.0.2").To4()
+	for i, result := range []int{PacketProcessResultOK, PacketProcessResultOK, PacketProcessResultDrop} {
+		if verdict := matcher.Match(&incoming, 0); verdict.Result != result || verdict.RuleName != "drop" {
+			t.Fatalf("invalid rate limit result for incoming packet %d", i)
+		}
+	}
+	incoming.SIp = net.ParseIP("10.0.1.3").To4()
+	if verdict := matcher.Match(&incoming, 0); verdict.Result != PacketProcessResultDrop {
+		t.Fatal("conversations of the same subscriber should share the bucket")
+	}
+	if err := matcher.SetSubscriberNetworks([]string{"x"}); err == nil {
+		t.Fatal("invalid subscriber network should be rejected")
+	}
+
+	//invalid action
+	if err := compileTestRules(`{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","rate_limit":"1mbit","rate_limit_action":"x"}]}`); err == nil {
+		t.Fatal("invalid rate limit action should be rejected")
+	}
+	if err := compileTestRules(`{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","rate_limit":"1mbit","rate_limit_burst":"1kb"}]}`); err == nil {
+		t.Fatal("burst below one MTU should be rejected")
+	}
+}
+
+func TestMatcherSchedule(t *testing.T) {
+	rules := `
+	{
+		"rules":[
+			{
+				"name":"school_nights",
+				"destination":"10.1.0.0/16",
+				"usage_size":"1kb",
+				"protocol" : "any",
+				"schedule" : {
+					"time_ranges" : ["22:00-07:00"],
+					"days" : ["sun", "mon", "tue", "wed", "thu"],
+					"timezone" : "UTC"
+				}
+			},
+			{
+				"name":"always",
+				"destination":"10.1.0.0/16",
+				"usage_size":"256mb",
+				"protocol" : "any"
+			}
+		]
+	}
+	`
+	clock := &cFakeClock{}
+	conv := CreateConversationTracker(3600*24*7, 2048, ConversationTableFullEvict, clock)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, clock)
+
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("10.1.2.3").To4()
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_TCP
+	packet.DataSize = 2000
+
+	//2024-01-01 is a Monday
+	checkSenario := func(day int, hour int, minute int, policyName string, result int) {
+		clock.Set(time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC))
+		if verdict := matcher.Match(&packet, 0); verdict.RuleName != policyName || verdict.Result != result {
+			t.Fatalf("match failed at %s, %s %d", clock.Now().Format(time.RFC1123), verdict.RuleName, verdict.Result)
+		}
+	}
+
+	checkSenario(1, 23, 0, "school_nights", PacketProcessResultDrop)
+	checkSenario(2, 6, 59, "school_nights", PacketProcessResultDrop)
+	checkSenario(2, 7, 0, "always", PacketProcessResultOK)
+	checkSenario(1, 12, 0, "always", PacketProcessResultOK)
+
+	//the night of Friday is not a school night, but the night of Sunday is
+	checkSenario(5, 23, 0, "always", PacketProcessResultOK)
+	checkSenario(6, 6, 30, "always", PacketProcessResultOK)
+	checkSenario(1, 6, 30, "school_nights", PacketProcessResultDrop)
+
+	//invalid schedules
+	for _, schedule := range []string{
+		`{"time_ranges":["25:00-07:00"]}`,
+		`{"time_ranges":["22:00"]}`,
+		`{"time_ranges":["22:00-22:00"]}`,
+		`{"days":["someday"]}`,
+		`{"timezone":"Invalid/Zone"}`,
+	} {
+		if err := compileTestRules(`{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","schedule":` + schedule + `}]}`); err == nil {
+			t.Fatalf("invalid schedule %s should be rejected", schedule)
+		}
+	}
+}
+
+func TestMatcherEvaluationModes(t *testing.T) {
+	rules := `
+	{
+		"rules":[
+			{
+				"name":"global",
+				"priority":1,
+				"destination":"0.0.0.0/0",
+				"usage_size":"3kb",
+				"protocol" : "any"
+			},
+			{
+				"name":"subnet",
+				"priority":5,
+				"destination":"10.2.0.0/24",
+				"usage_size":"256mb",
+				"protocol" : "tcp"
+			}
+		]
+	}
+	`
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("10.2.0.1").To4()
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_TCP
+	packet.DataSize = 2000
+
+	checkSenario := func(mode int, expected [][]string, results []int) {
+		conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+		matcher := createTestMatcher(t, rules, conv, mode, nil, nil)
+		for i, result := range results {
+			verdict := matcher.Match(&packet, 0)
+			if verdict.Result != result || verdict.RuleName != expected[i][0] || strings.Join(verdict.Rules, ",") != strings.Join(expected[i][1:], ",") {
+				t.Fatalf("invalid verdict for mode %s, %s %v %d", GetRuleEvaluationModeName(mode), verdict.RuleName, verdict.Rules, verdict.Result)
+			}
+		}
+	}
+
+	//the subnet rule shadows the global quota
+	checkSenario(RuleEvaluationLongestPrefix, [][]string{{"subnet", "subnet"}, {"subnet", "subnet"}}, []int{PacketProcessResultOK, PacketProcessResultOK})
+
+	//the global rule has the highest priority
+	checkSenario(RuleEvaluationPriority, [][]string{{"global", "global"}, {"global", "global"}}, []int{PacketProcessResultOK, PacketProcessResultDrop})
+
+	//both the rules should pass. the conversation keeps the rule closest to its quota
+	checkSenario(RuleEvaluationAll, [][]string{{"global", "global", "subnet"}, {"global", "global"}}, []int{PacketProcessResultOK, PacketProcessResultDrop})
+}
+
+func TestMatcherAllowDeny(t *testing.T) {
+	rules := `
+	{
+		"exempt_networks":["192.168.100.0/24"],
+		"rules":[
+			{
+				"name":"blocked",
+				"type":"deny",
+				"destination":"203.0.113.5/32",
+				"protocol" : "any"
+			},
+			{
+				"name":"rejected",
+				"type":"deny",
+				"destination":"203.0.113.6/32",
+				"protocol" : "any",
+				"action" : "reject"
+			},
+			{
+				"name":"lan",
+				"type":"allow",
+				"destination":"10.0.0.0/8",
+				"protocol" : "any"
+			},
+			{
+				"name":"global",
+				"destination":"0.0.0.0/0",
+				"usage_size":"1kb",
+				"protocol" : "any"
+			}
+		]
+	}
+	`
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationAll, nil, nil)
+
+	packet := SPacket{}
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_TCP
+	packet.DataSize = 2000
+
+	checkSenario := func(src string, dst string, policyName string, result int) {
+		packet.SIp = net.ParseIP(src).To4()
+		packet.DIp = net.ParseIP(dst).To4()
+		if verdict := matcher.Match(&packet, 0); verdict.RuleName != policyName || verdict.Result != result {
+			t.Fatalf("match failed for %s -> %s, %s %d", src, dst, verdict.RuleName, verdict.Result)
+		}
+	}
+
+	//the allow rule short-circuits the global quota
+	checkSenario("192.168.0.1", "10.1.1.1", "lan", PacketProcessResultOK)
+	checkSenario("192.168.0.1", "10.1.1.1", "lan", PacketProcessResultOK)
+	checkSenario("192.168.0.1", "8.8.8.8", "global", PacketProcessResultDrop)
+
+	//deny rules and exempt networks do not allocate any conversation
+	items := conv.(*CConversationTracker).hashLinkList.GetItemsCount()
+	checkSenario("192.168.0.1", "203.0.113.5", "blocked", PacketProcessResultDrop)
+	checkSenario("203.0.113.5", "192.168.0.2", "blocked", PacketProcessResultDrop)
+	checkSenario("192.168.0.1", "203.0.113.6", "rejected", PacketProcessResultReject)
+	checkSenario("192.168.100.5", "8.8.8.8", "", PacketProcessResultOK)
+	checkSenario("8.8.8.8", "192.168.100.5", "", PacketProcessResultOK)
+	if conv.(*CConversationTracker).hashLinkList.GetItemsCount() != items {
+		t.Fatal("conversation should not be tracked")
+	}
+
+	//invalid rules
+	for _, rule := range []string{
+		`{"name":"x","type":"allow","destination":"0.0.0.0/0","protocol":"any","usage_size":"1kb"}`,
+		`{"name":"x","type":"deny","destination":"0.0.0.0/0","protocol":"any","action":"mark","mark":1}`,
+		`{"name":"x","type":"x","destination":"0.0.0.0/0","protocol":"any"}`,
+	} {
+		if err := compileTestRules(`{"rules":[` + rule + `]}`); err == nil {
+			t.Fatalf("invalid rule %s should be rejected", rule)
+		}
+	}
+	if err := compileTestRules(`{"exempt_networks":["x"]}`); err == nil {
+		t.Fatal("invalid exempt network should be rejected")
+	}
+}
+
+func TestMatcherPools(t *testing.T) {
+	rules := `
+	{
+		"pools":[
+			{
+				"name":"family",
+				"size":"4kb"
+			}
+		],
+		"rules":[
+			{
+				"name":"family",
+				"sources":["192.168.0.1", "192.168.0.2"],
+				"destination":"0.0.0.0/0",
+				"protocol" : "any",
+				"pool" : "family"
+			}
+		]
+	}
+	`
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, nil)
+
+	packet := SPacket{}
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_TCP
+	packet.DataSize = 1024
+
+	checkSenario := func(src string, dst string, result int) {
+		packet.SIp = net.ParseIP(src).To4()
+		packet.DIp = net.ParseIP(dst).To4()
+		if verdict := matcher.Match(&packet, 0); verdict.RuleName != "family" || verdict.Result != result {
+			t.Fatalf("match failed for %s -> %s, %s %d", src, dst, verdict.RuleName, verdict.Result)
+		}
+	}
+	getPool := func() SQuotaPoolStatus {
+		pools := []SQuotaPoolStatus{}
+		if err := json.Unmarshal([]byte(matcher.DumpPools()), &pools); err != nil || len(pools) != 1 {
+			t.Fatal("invalid pools")
+		}
+		return pools[0]
+	}
+
+	//all the devices share the pool
+	checkSenario("192.168.0.1", "8.8.8.8", PacketProcessResultOK)
+	checkSenario("192.168.0.1", "8.8.8.8", PacketProcessResultOK)
+	checkSenario("192.168.0.2", "1.1.1.1", PacketProcessResultOK)
+	checkSenario("192.168.0.2", "1.1.1.1", PacketProcessResultOK)
+	checkSenario("192.168.0.2", "1.1.1.1", PacketProcessResultDrop)
+	checkSenario("192.168.0.1", "8.8.8.8", PacketProcessResultDrop)
+	if pool := getPool(); pool.Used != 4096 || pool.Remaining != 0 {
+		t.Fatal("invalid pool usage")
+	}
+
+	//top up
+	if err := matcher.TopUpPool("family", "1kb"); err != nil {
+		t.Fatal(err)
+	}
+	checkSenario("192.168.0.1", "8.8.8.8", PacketProcessResultOK)
+	checkSenario("192.168.0.1", "8.8.8.8", PacketProcessResultDrop)
+
+	//the pool is kept after reloading the rules
+	if _, err := matcher.(*CRuleMatcher).loadRules(); err != nil {
+		t.Fatal(err)
+	}
+	if pool := getPool(); pool.Used != 5120 || pool.TopUp != 1024 {
+		t.Fatal("pool should be kept")
+	}
+
+	//reset
+	if err := matcher.ResetPool("family"); err != nil || getPool().Used != 0 {
+		t.Fatal("can not reset the pool")
+	}
+	checkSenario("192.168.0.2", "1.1.1.1", PacketProcessResultOK)
+	if matcher.TopUpPool("unknown", "1kb") == nil || matcher.ResetPool("unknown") == nil {
+		t.Fatal("unknown pool should be rejected")
+	}
+
+	//the packets blocked by the later rules are not charged
+	rules = `
+	{
+		"pools":[{"name":"family","size":"4kb"}],
+		"rules":[
+			{"name":"family","priority":1,"destination":"0.0.0.0/0","protocol":"any","pool":"family"},
+			{"name":"video","priority":2,"destination":"1.1.1.0/24","protocol":"any","usage_size":"2kb"}
+		]
+	}
+	`
+	conv = CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher = createTestMatcher(t, rules, conv, RuleEvaluationAll, nil, nil)
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("1.1.1.1").To4()
+	passed := int64(0)
+	for i := 0; i < 4; i++ {
+		if matcher.Match(&packet, 0).Result == PacketProcessResultOK {
+			passed++
+		}
+	}
+	if passed == 0 || passed == 4 {
+		t.Fatalf("invalid passed packets %d", passed)
+	}
+	if pool := getPool(); pool.Used != passed*1024 {
+		t.Fatalf("blocked packets charged, %d", pool.Used)
+	}
+
+	//invalid pools
+	for _, data := range []string{
+		`{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","pool":"unknown"}]}`,
+		`{"pools":[{"name":"p","size":"1kb"}],"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","pool":"p","usage_size":"1kb"}]}`,
+		`{"pools":[{"name":"p","size":"1kb"},{"name":"p","size":"2kb"}]}`,
+		`{"pools":[{"name":"p","size":"1xb"}]}`,
+	} {
+		if err := compileTestRules(data); err == nil {
+			t.Fatalf("invalid pools %s should be rejected", data)
+		}
+	}
+}
+
+func TestMatcherRuleCache(t *testing.T) {
+	rules := `{"rules":[{"name":"first","destination":"10.4.0.0/16","usage_size":"256mb","protocol":"any"}]}`
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, nil)
+	repos := matcher.(*CRuleMatcher).ruleRepos
+
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("10.4.0.1").To4()
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_TCP
+	packet.DataSize = 100
+
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "first" {
+		t.Fatal("match failed")
+	}
+	_, status := conv.GetStatus(&packet, 0)
+	if cache := status.ruleCache[getRuleCacheSlot(PROTOCOL_TCP)]; cache == nil || cache.generation != matcher.(*CRuleMatcher).ruleSet.generation {
+		t.Fatal("rules should be cached")
+	}
+	if status.ruleCache[getRuleCacheSlot(PROTOCOL_UDP)] != nil {
+		t.Fatal("each protocol has its own cache")
+	}
+
+	//reloading the rules invalidates the cache
+	repos.(*CJsonRuleRepository).loadRulesFromString(`{"rules":[{"name":"second","destination":"10.4.0.0/24","usage_size":"256mb","protocol":"any"}]}`)
+	if _, err := matcher.(*CRuleMatcher).loadRules(); err != nil {
+		t.Fatal(err)
+	}
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "second" {
+		t.Fatal("cache should be invalidated")
+	}
+}
+
+func benchmarkMatcher(b *testing.B, disableRuleCache bool) {
+	repos := new(CJsonRuleRepository)
+	for i := 0; i < 10000; i++ {
+		repos.Rules = append(repos.Rules, SRule{
+			Name:        fmt.Sprintf("rule%d", i),
+			Destination: fmt.Sprintf("10.%d.%d.0/24", i/256, i%256),
+			UsageSize:   "100gb",
+			L4Protocol:  "any",
+		})
+	}
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher, err := CreateMatcher(repos, conv, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer matcher.Close()
+	matcher.(*CRuleMatcher).disableRuleCache = disableRuleCache
+
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("10.20.30.1").To4()
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_TCP
+	packet.DataSize = 100
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if verdict := matcher.Match(&packet, 0); verdict.RuleName != "rule5150" {
+			b.Fatal("match failed")
+		}
+	}
+}
+
+func BenchmarkMatcherWithRuleCache(b *testing.B) {
+	benchmarkMatcher(b, false)
+}
+
+func BenchmarkMatcherWithoutRuleCache(b *testing.B) {
+	benchmarkMatcher(b, true)
+}
+
+func TestMatcherReload(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rules.json")
+	writeRules := func(rules string) {
+		if err := ioutil.WriteFile(fileName, []byte(rules), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeRules(`{"rules":[{"name":"first","destination":"10.5.0.0/16","usage_size":"2kb","protocol":"any"}]}`)
+
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	repos, err := CreateJsonRuleRepository(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher, err := CreateMatcher(repos, conv, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matcher.Close()
+
+	packet := SPacket{}
+	packet.SIp = net.ParseIP("192.168.0.1").To4()
+	packet.DIp = net.ParseIP("10.5.0.1").To4()
+	packet.IpVersion = 4
+	packet.Protocol = PROTOCOL_TCP
+	packet.DataSize = 1500
+
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "first" || verdict.Result != PacketProcessResultOK {
+		t.Fatal("match failed")
+	}
+
+	//the conversation counters are kept after the reload
+	writeRules(`{"rules":[{"name":"second","destination":"10.5.0.0/16","usage_size":"2kb","protocol":"any"}]}`)
+	if err := matcher.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "second" || verdict.Result != PacketProcessResultDrop {
+		t.Fatal("rules should be reloaded")
+	}
+
+	//the current rules stay active on any error
+	writeRules(`{"rules":[{"name":"third","destination":"invalid","protocol":"any"}]}`)
+	if err := matcher.Reload(); err == nil {
+		t.Fatal("invalid rules should be rejected")
+	}
+	if verdict := matcher.Match(&packet, 0); verdict.RuleName != "second" {
+		t.Fatal("current rules should be kept")
+	}
+
+	status := SRuleReloadStatus{}
+	if err := json.Unmarshal([]byte(matcher.DumpReloadStatus()), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Reloads != 1 || status.Failures != 1 || status.LastError == "" || status.Version != 2 || status.Pinned {
+		t.Fatal("invalid reload status")
+	}
+}
+
+//the reloads and the activations of the repository rules run concurrently, go test -race checks them
+func TestMatcherConcurrentReload(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rules.json")
+	data := `{"rules":[{"name":"first","destination":"10.5.0.0/16","protocol":"any"}],"groups":[{"name":"g","members":["10.6.0.1"]}]}`
+	if err := ioutil.WriteFile(fileName, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repos, err := CreateJsonRuleRepository(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher, err := CreateMatcher(repos, nil, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer matcher.Close()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if i%2 == 0 {
+					matcher.Reload()
+				} else {
+					matcher.ActivateRuleVersion(0)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if rules := repos.GetSnapshot().Rules; len(rules) != 1 || rules[0].Name != "first" {
+		t.Fatal("invalid rules")
+	}
+}
+
+func TestMatcherErrors(t *testing.T) {
+	for _, item := range []struct {
+		rules string
+		rule  string
+		field string
+	}{
+		{`{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","action":"mark"}]}`, "x", "mark"},
+		{`{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","usage_size":"1xb"}]}`, "x", "usage_size"},
+		{`{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","usage_time":"1x"}]}`, "x", "usage_time"},
+		{`{"rules":[{"name":"x","destination":"10.0.0.0/33","protocol":"any"}]}`, "x", "destination"},
+		{`{"rules":[{"name":"x","sources":["unknown"],"destination":"0.0.0.0/0","protocol":"any"}]}`, "x", "sources"},
+		{`{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","schedule":{"days":["someday"]}}]}`, "x", "schedule"},
+		{`{"rules":[{"name":"x","destination":"10.0.0.0/8","protocol":"any"},{"name":"y","destination":"10.0.0.0/8","protocol":"any"}]}`, "y", "destination"},
+		{`{"pools":[{"name":"p","size":"1xb"}]}`, "", "pools"},
+		{`{"exempt_networks":["x"]}`, "", "exempt_networks"},
+	} {
+		err := compileTestRules(item.rules)
+		ruleErr := new(SRuleError)
+		if !errors.As(err, &ruleErr) {
+			t.Fatalf("invalid error %v for %s", err, item.rules)
+		}
+		if ruleErr.Rule != item.rule || ruleErr.Field != item.field || ruleErr.Reason == "" {
+			t.Fatalf("invalid error %+v for %s", ruleErr, item.rules)
+		}
+	}
+
+	//the matcher is not created for the invalid rules
+	repos, err := CreateJsonRuleRepositoryFromStr(`{"rules":[{"name":"x","destination":"0.0.0.0/0","protocol":"any","action":"x"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matcher, err := CreateMatcher(repos, nil, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil); matcher != nil || err == nil {
+		t.Fatal("invalid rules should be rejected")
+	}
+}
+
+func TestMatcherDumpRules(t *testing.T) {
+	rules := `
+	{
+		"pools":[{"name":"family","size":"10240MiB"}],
+		"rules":[
+			{"name":"first","destination":"10.0.0.0/8","protocol":"any","usage_size":"1536 MB","usage_time":"90m"},
+			{"name":"second","destination":"10.1.0.0/16","protocol":"any","pool":"family","rate_limit":"2048kbit","rate_limit_after":"1.5gb"}
+		]
+	}`
+	conv := CreateConversationTracker(3600, 2048, ConversationTableFullEvict, nil)
+	matcher := createTestMatcher(t, rules, conv, RuleEvaluationLongestPrefix, nil, nil)
+
+	//the active rules could be loaded again
+	dump := matcher.DumpRules()
+	repos, err := CreateJsonRuleRepositoryFromStr(dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := repos.GetRules()[0]
+	second := repos.GetRules()[1]
+	if first.UsageSize != "1.5gb" || first.UsageTime != "1h30m" || repos.GetPools()[0].Size != "10gb" {
+		t.Fatalf("invalid rules %s", dump)
+	}
+	if second.UsageSize != "" || second.RateLimit != "2.048mbit" || second.RateBurst != "250kb" || second.RateAfter != "1.5gb" {
+		t.Fatalf("invalid rules %s", dump)
+	}
+	loaded, err := CreateMatcher(repos, nil, RuleEvaluationLongestPrefix, SizeUnitsBinary, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.Close()
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+//compiled sources of a rule. a rule without any source applies to all the subscribers
+type sSourceSelector struct {
+	Networks []*net.IPNet
+	MACs     []string
+	Key      string
+}
+
+//---------------------------------------------------------------------------------------
+//return the specificity of the match or -1 if the subscriber does not match. MAC addresses are the most
+//specific ones, then the networks by their prefix length and then the rules without any source
+func (thisPt *sSourceSelector) match(ip net.IP, mac net.HardwareAddr) int {
+	if len(thisPt.Networks) == 0 && len(thisPt.MACs) == 0 {
+		return 0
+	}
+
+	if len(mac) > 0 {
+		macStr := mac.String()
+		for _, m := range thisPt.MACs {
+			if m == macStr {
+				return 200
+			}
+		}
+	}
+
+	best := -1
+	for _, network := range thisPt.Networks {
+		if network.Contains(ip) {
+			if bits, _ := network.Mask.Size(); bits+1 > best {
+				best = bits + 1
+			}
+		}
+	}
+	return best
+}
+
+//---------------------------------------------------------------------------------------
+//sort the rules of a list by their score, the highest first
+type sScoredRules struct {
+	rules  []sCompiledRule
+	scores []int
+}
+
+func (thisPt sScoredRules) Len() int {
+	return len(thisPt.rules)
+}
+
+func (thisPt sScoredRules) Less(i, j int) bool {
+	return thisPt.scores[i] > thisPt.scores[j]
+}
+
+func (thisPt sScoredRules) Swap(i, j int) {
+	thisPt.rules[i], thisPt.rules[j] = thisPt.rules[j], thisPt.rules[i]
+	thisPt.scores[i], thisPt.scores[j] = thisPt.scores[j], thisPt.scores[i]
+}
+
+//---------------------------------------------------------------------------------------
+//candidate rules of a conversation for a protocol, ordered for the evaluation. the cache is valid until the
+//generation of the rule set changes
+type sRuleCache struct {
+	generation uint64
+	rules      []sCompiledRule
+}
+
+//---------------------------------------------------------------------------------------
+//the rules just check tcp, udp and any, so all the other protocols share a cache slot
+func getRuleCacheSlot(protocol uint16) int {
+	if protocol == PROTOCOL_TCP {
+		return 0
+	} else if protocol == PROTOCOL_UDP {
+		return 1
+	}
+	return 2
+}
+
+//---------------------------------------------------------------------------------------
+//compiled rules and their TRIs. a rule set is not changed after the build, the matcher replaces it as a whole
+type sRuleSet struct {
+	generation    uint64
+	rules         []sCompiledRule
+	denyRules     *sRuleSet
+	exempt        []*net.IPNet
+	defaultRules  sCompiledRulesList
+	defaultRules6 sCompiledRulesList
+	ipTri         cIPTrie
+	ipTri6        cIPTrie
+}
+
+//---------------------------------------------------------------------------------------
+//add the rule to the rule list of the network
+func (thisPt *sRuleSet) addRule(network string, cmp sCompiledRule) error {
+
+	//check for duplicate rules for a subnet. returns the existing rule
+	checkForDuplicate := func(ruleList *sCompiledRulesList, cmp *sCompiledRule) *sCompiledRule {
+		for i, r := range *ruleList {
+			if r.Protocol == cmp.Protocol && r.Sources.Key == cmp.Sources.Key && r.Schedule.getKey() == cmp.Schedule.getKey() {
+				return &(*ruleList)[i]
+			}
+		}
+		return nil
+	}
+
+	//We may have different rules for each protocol in a subnet for example 192.168.1.0:udp and 192.168.1.0:tcp or 192.168.1.0:any
+	var ruleList *sCompiledRulesList
+
+	//each IP version has its own TRI. the version is chosen by the length of the network, so the IPv4-mapped
+	//prefixes like ::ffff:10.0.0.0/104 are IPv6 networks
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return newRuleError(cmp.Name, "destination", err.Error())
+	}
+	ipTri := &thisPt.ipTri
+	if len(ipNet.Mask) != net.IPv4len {
+		ipTri = &thisPt.ipTri6
+	}
+
+	//default policy
+	if network == DEFAULT_NET {
+		ruleList = &thisPt.defaultRules
+	} else if network == DEFAULT_NET6 {
+		ruleList = &thisPt.defaultRules6
+	} else if listInter := ipTri.SearchExactString(network); listInter != nil {
+		ruleList = listInter.(*sCompiledRulesList)
+	} else {
+		ruleList = new(sCompiledRulesList)
+		if err := ipTri.AddString(network, ruleList); err != nil {
+			return newRuleError(cmp.Name, "destination", err.Error())
+		}
+	}
+
+	//check for duplicate rules. the sources of the rules are reported, they could be in different files
+	if dup := checkForDuplicate(ruleList, &cmp); dup != nil {
+		reason := fmt.Sprintf("duplicate rules detected for %s, the rule conflicts with %s", network, describeRule(dup.Name, dup.Origin))
+		return &SRuleError{Rule: cmp.Name, Origin: cmp.Origin, Field: "destination", Reason: reason}
+	}
+
+	*ruleList = append(*ruleList, cmp)
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+//return all the rules of a conversation ordered by their precedence, whether their schedule is active or not.
+//the precedence is
+//	1- the longest destination prefix. the default networks are the last ones
+//	2- the most specific source. MAC address, then the longest source prefix and then the rules without any source
+//	3- the exact protocol, then any
+//	4- the rules with a schedule, then the rules without any schedule
+func (thisPt *sRuleSet) findCandidates(remote net.IP, local net.IP, localMAC net.HardwareAddr, protocol uint16, ipVersion uint8) []sCompiledRule {
+	rules := []sCompiledRule{}
+
+	//add the matched rules of a list
+	addRuleList := func(list *sCompiledRulesList) {
+		matched := []sCompiledRule{}
+		scores := []int{}
+		for _, rule := range *list {
+			if rule.Protocol != protocol && rule.Protocol != PROTOCOL_ANY {
+				continue
+			}
+			score := rule.Sources.match(local, localMAC)
+			if score < 0 {
+				continue
+			}
+			score *= 2
+			if rule.Protocol == protocol {
+				score++
+			}
+			score *= 2
+			if rule.Schedule != nil {
+				score++
+			}
+			matched = append(matched, rule)
+			scores = append(scores, score)
+		}
+		sort.Stable(sScoredRules{rules: matched, scores: scores})
+		rules = append(rules, matched...)
+	}
+
+	//select the IP version
+	ipTri := &thisPt.ipTri
+	defaultRules := &thisPt.defaultRules
+	if ipVersion == 6 {
+		ipTri = &thisPt.ipTri6
+		defaultRules = &thisPt.defaultRules6
+	}
+
+	//check ip TRI, longest prefix first and then the default rules
+	for _, ruleListIn := range ipTri.SearchAll(remote) {
+		addRuleList(ruleListIn.(*sCompiledRulesList))
+	}
+	addRuleList(defaultRules)
+	return rules
+}
+
+//---------------------------------------------------------------------------------------
+//return the rules of a conversation that their schedule is active, see findCandidates for the precedence
+func (thisPt *sRuleSet) findRules(remote net.IP, local net.IP, localMAC net.HardwareAddr, protocol uint16, ipVersion uint8, now time.Time) []sCompiledRule {
+	return filterActiveRules(thisPt.findCandidates(remote, local, localMAC, protocol, ipVersion), now)
+}
+
+//---------------------------------------------------------------------------------------
+//remove the rules outside of their schedule. the list is not changed, it could be shared
+func filterActiveRules(rules []sCompiledRule, now time.Time) []sCompiledRule {
+	for i := range rules {
+		if !rules[i].Schedule.active(now) {
+			active := append([]sCompiledRule{}, rules[:i]...)
+			for _, rule := range rules[i+1:] {
+				if rule.Schedule.active(now) {
+					active = append(active, rule)
+				}
+			}
+			return active
+		}
+	}
+	return rules
+}
+
+//---------------------------------------------------------------------------------------
+//return true if the address is in the exempt networks
+func (thisPt *sRuleSet) isExempt(ip net.IP) bool {
+	for _, network := range thisPt.exempt {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+//return the deny rule of a packet. there is not any conversation yet, so both the endpoints are checked as the subscriber
+func (thisPt *sRuleSet) findDenyRule(packet *SPacket, now time.Time) (bool, sCompiledRule) {
+	if rules := thisPt.denyRules.findRules(packet.DIp, packet.SIp, packet.SrcMAC, uint16(packet.Protocol), packet.IpVersion, now); len(rules) > 0 {
+		return true, rules[0]
+	}
+	if rules := thisPt.denyRules.findRules(packet.SIp, packet.DIp, nil, uint16(packet.Protocol), packet.IpVersion, now); len(rules) > 0 {
+		return true, rules[0]
+	}
+	return false, sCompiledRule{}
+}
+
+//---------------------------------------------------------------------------------------
+//build a new rule set. every network of a rule, for example all the addresses of a host, shares the rule.
+//deny rules are kept in their own rule set
+func createRuleSet(cmpRules []sCompiledRule, exempt []*net.IPNet) (*sRuleSet, error) {
+	ruleSet := new(sRuleSet)
+	ruleSet.ipTri.Init(4)
+	ruleSet.ipTri6.Init(6)
+	ruleSet.rules = cmpRules
+	ruleSet.exempt = exempt
+
+	ruleSet.denyRules = new(sRuleSet)
+	ruleSet.denyRules.ipTri.Init(4)
+	ruleSet.denyRules.ipTri6.Init(6)
+
+	for _, cmp := range cmpRules {
+		target := ruleSet
+		if cmp.Type == RuleTypeDeny {
+			target = ruleSet.denyRules
+		}
+		for _, network := range cmp.Networks {
+			if err := target.addRule(network, cmp); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return ruleSet, nil
+}
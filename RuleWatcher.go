@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+//wait for the editors to finish writing the rules file
+const RuleWatchDelay = 500 * time.Millisecond
+
+//---------------------------------------------------------------------------------------
+//watch the rules file and its included files and call the reload function when they are changed. the directories
+//are watched, since the editors usually replace the files. the included files are updated before each reload
+type CRuleFileWatcher struct {
+	watcher  *fsnotify.Watcher
+	fileName string
+	files    []string
+	dirs     map[string]bool
+	reload   func()
+	timer    *time.Timer
+	lock     sync.Mutex
+}
+
+//---------------------------------------------------------------------------------------
+//watch the file, its included files and the include globs. the current files are kept if the file is not valid
+func (thisPt *CRuleFileWatcher) updateFiles() error {
+	files := []string{thisPt.fileName}
+	if rules, err := loadRuleFiles(thisPt.fileName, map[string]bool{}); err == nil {
+		files = rules.files
+	} else {
+		thisPt.lock.Lock()
+		files = append(files, thisPt.files...)
+		thisPt.lock.Unlock()
+	}
+
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	for _, file := range files {
+		//the directories of the globs like */rules.json could not be watched
+		dir := filepath.Dir(file)
+		if thisPt.dirs[dir] || strings.ContainsAny(dir, "*?[") {
+			continue
+		}
+		if err := thisPt.watcher.Add(dir); err != nil {
+			return err
+		}
+		thisPt.dirs[dir] = true
+	}
+	thisPt.files = files
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CRuleFileWatcher) isWatched(fileName string) bool {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+	for _, file := range thisPt.files {
+		if matched, _ := filepath.Match(file, fileName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CRuleFileWatcher) onChange() {
+	thisPt.lock.Lock()
+	defer thisPt.lock.Unlock()
+
+	//several events are reported for a single change
+	if thisPt.timer != nil {
+		thisPt.timer.Stop()
+	}
+	thisPt.timer = time.AfterFunc(RuleWatchDelay, func() {
+		if err := thisPt.updateFiles(); err != nil {
+			log.Printf("can not watch the included rules files, %v \n", err)
+		}
+		thisPt.reload()
+	})
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CRuleFileWatcher) watch() {
+	for {
+		select {
+		case event, ok := <-thisPt.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 && thisPt.isWatched(filepath.Clean(event.Name)) {
+				thisPt.onChange()
+			}
+		case err, ok := <-thisPt.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("rules file watcher error, %v \n", err)
+		}
+	}
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *CRuleFileWatcher) Stop() {
+	thisPt.watcher.Close()
+	thisPt.lock.Lock()
+	if thisPt.timer != nil {
+		thisPt.timer.Stop()
+	}
+	thisPt.lock.Unlock()
+}
+
+//---------------------------------------------------------------------------------------
+func CreateRuleFileWatcher(fileName string, reload func()) (*CRuleFileWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	fileName, err = filepath.Abs(fileName)
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	ruleWatcher := new(CRuleFileWatcher)
+	ruleWatcher.watcher = watcher
+	ruleWatcher.fileName = fileName
+	ruleWatcher.dirs = map[string]bool{}
+	ruleWatcher.reload = reload
+	if err := ruleWatcher.updateFiles(); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go ruleWatcher.watch()
+	return ruleWatcher, nil
+}
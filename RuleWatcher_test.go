@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRuleFileWatcher(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "rules.json")
+	if err := ioutil.WriteFile(fileName, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reloads := make(chan bool, 16)
+	watcher, err := CreateRuleFileWatcher(fileName, func() { reloads <- true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Stop()
+
+	//the other files of the directory are ignored
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloads:
+		t.Fatal("other files should be ignored")
+	case <-time.After(2 * RuleWatchDelay):
+	}
+
+	//several writes just trigger a reload
+	for i := 0; i < 3; i++ {
+		if err := ioutil.WriteFile(fileName, []byte(`{"rules":[]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rules file change is not detected")
+	}
+	select {
+	case <-reloads:
+		t.Fatal("changes should be merged")
+	case <-time.After(2 * RuleWatchDelay):
+	}
+
+	//the included files and the new files of the include globs are watched after the reload
+	customers := filepath.Join(dir, "customers")
+	if err := os.Mkdir(customers, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, []byte(`{"include":["customers/*.json"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"first.json", "first.json", "second.json"} {
+		select {
+		case <-reloads:
+		case <-time.After(5 * time.Second):
+			t.Fatal("rules file change is not detected")
+		}
+		if err := ioutil.WriteFile(filepath.Join(customers, name), []byte(`{"rules":[]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("included file change is not detected")
+	}
+	if err := ioutil.WriteFile(filepath.Join(customers, "notes.txt"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reloads:
+		t.Fatal("other files of the included directories should be ignored")
+	case <-time.After(2 * RuleWatchDelay):
+	}
+}
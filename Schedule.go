@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+//---------------------------------------------------------------------------------------
+//a daily time range in minutes. ranges with end < start cross the midnight
+type sTimeRange struct {
+	Start int
+	End   int
+}
+
+//---------------------------------------------------------------------------------------
+//compiled rule schedule. a range crossing the midnight belongs to the day it starts
+type sSchedule struct {
+	Ranges   []sTimeRange
+	Days     [7]bool
+	Location *time.Location
+	Key      string
+}
+
+//---------------------------------------------------------------------------------------
+//return true if the schedule is active at the time. rules without schedule are always active
+func (thisPt *sSchedule) active(now time.Time) bool {
+	if thisPt == nil {
+		return true
+	}
+
+	local := now.In(thisPt.Location)
+	minute := local.Hour()*60 + local.Minute()
+	day := int(local.Weekday())
+	yesterday := (day + 6) % 7
+
+	for _, r := range thisPt.Ranges {
+		if r.Start < r.End {
+			if thisPt.Days[day] && minute >= r.Start && minute < r.End {
+				return true
+			}
+			continue
+		}
+
+		//the part after the midnight belongs to the previous day
+		if thisPt.Days[day] && minute >= r.Start {
+			return true
+		}
+		if thisPt.Days[yesterday] && minute < r.End {
+			return true
+		}
+	}
+	return false
+}
+
+//---------------------------------------------------------------------------------------
+//used to detect the duplicate rules
+func (thisPt *sSchedule) getKey() string {
+	if thisPt == nil {
+		return ""
+	}
+	return thisPt.Key
+}
+
+//---------------------------------------------------------------------------------------
+//convert hh:mm to minutes. 24:00 is just valid as the end of a range
+func parseDayTime(item string, isEnd bool) (int, error) {
+	var hour, minute int
+	if n, err := fmt.Sscanf(item, "%d:%d", &hour, &minute); err != nil || n != 2 || len(item) != 5 {
+		return 0, fmt.Errorf("invalid time %s", item)
+	}
+	if hour == 24 && minute == 0 && isEnd {
+		return 24 * 60, nil
+	}
+	if hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("invalid time %s", item)
+	}
+	return hour*60 + minute, nil
+}
+
+//---------------------------------------------------------------------------------------
+//convert the name of a day to its days. weekdays and weekend are accepted too
+func parseDays(item string) ([]time.Weekday, error) {
+	item = strings.ToLower(item)
+	switch item {
+	case "weekdays":
+		return []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}, nil
+	case "weekend":
+		return []time.Weekday{time.Saturday, time.Sunday}, nil
+	}
+
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		name := strings.ToLower(day.String())
+		if item == name || item == name[:3] {
+			return []time.Weekday{day}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid day %s", item)
+}
+
+//---------------------------------------------------------------------------------------
+//build the schedule of a rule. returns nil if the rule does not have a schedule
+func compileSchedule(schedule *SSchedule) (*sSchedule, error) {
+	if schedule == nil {
+		return nil, nil
+	}
+
+	cmp := new(sSchedule)
+	cmp.Location = time.Local
+	if schedule.TimeZone != "" {
+		location, err := time.LoadLocation(schedule.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone %s", schedule.TimeZone)
+		}
+		cmp.Location = location
+	}
+
+	//all the days by default
+	if len(schedule.Days) == 0 {
+		for i := range cmp.Days {
+			cmp.Days[i] = true
+		}
+	}
+	for _, item := range schedule.Days {
+		days, err := parseDays(item)
+		if err != nil {
+			return nil, err
+		}
+		for _, day := range days {
+			cmp.Days[day] = true
+		}
+	}
+
+	//all the day by default
+	if len(schedule.TimeRanges) == 0 {
+		cmp.Ranges = []sTimeRange{{Start: 0, End: 24 * 60}}
+	}
+	for _, item := range schedule.TimeRanges {
+		parts := strings.Split(item, "-")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid time range %s", item)
+		}
+		start, err := parseDayTime(strings.TrimSpace(parts[0]), false)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseDayTime(strings.TrimSpace(parts[1]), true)
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, errors.New("empty time range")
+		}
+		cmp.Ranges = append(cmp.Ranges, sTimeRange{Start: start, End: end})
+	}
+
+	keys := []string{}
+	for _, r := range cmp.Ranges {
+		keys = append(keys, fmt.Sprintf("%d-%d", r.Start, r.End))
+	}
+	sort.Strings(keys)
+	cmp.Key = fmt.Sprintf("%s/%v/%s", strings.Join(keys, ","), cmp.Days, cmp.Location.String())
+	return cmp, nil
+}
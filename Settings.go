@@ -2,45 +2,96 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
-	"log"
-	"os"
 )
 
 type SSettings struct {
-	MaxConversations                uint32 `json:"max_conversation"`
-	MaxInactiveConversationLifeTime uint32 `json:"max_inactive_conversation_life_time"`
-	NFQueueNumber                   uint16 `json:"nfq_number"`
-	GWMode                          bool   `json:"gw_mode"`
-	RunIPCommands                   bool   `json:"run_iptables_command"`
+	MaxConversations                uint32   `json:"max_conversation"`
+	MaxInactiveConversationLifeTime uint32   `json:"max_inactive_conversation_life_time"`
+	ActiveTimeSlice                 uint32   `json:"active_time_slice"`
+	NFQueueNumber                   uint16   `json:"nfq_number"`
+	GWMode                          bool     `json:"gw_mode"`
+	RunIPCommands                   bool     `json:"run_iptables_command"`
+	TableFullPolicy                 string   `json:"conversation_table_full_policy"`
+	EvictIdleTime                   uint32   `json:"conversation_evict_idle_time"`
+	EvictFallbackPolicy             string   `json:"conversation_evict_fallback_policy"`
+	EventLogFile                    string   `json:"event_log_file"`
+	EventQueueSize                  int      `json:"event_queue_size"`
+	RuleEvaluationMode              string   `json:"rule_evaluation_mode"`
+	WatchRulesFile                  bool     `json:"watch_rules_file"`
+	RulesDatabase                   string   `json:"rules_database"`
+	RulesUrl                        string   `json:"rules_url"`
+	RulesPublicKey                  string   `json:"rules_public_key"`
+	RulesCacheFile                  string   `json:"rules_cache_file"`
+	RulesPollInterval               uint32   `json:"rules_poll_interval"`
+	RulesHistoryDir                 string   `json:"rules_history_dir"`
+	RulesHistorySize                uint32   `json:"rules_history_size"`
+	SubscriberNetworks              []string `json:"subscriber_networks"`
+	SizeUnits                       string   `json:"size_units"`
 }
 
 func LoadSettings(fileName string) (SSettings, error) {
+	set, _, err := LoadSettingsWithOverrides(fileName, nil, nil)
+	return set, err
+}
+
+//load the settings and apply the overrides, flags > env > file > defaults. env has the environment variables in the
+//os.Environ format and flags has the values of the flags by the json names of the settings. the source of each
+//setting is returned by its json name
+func LoadSettingsWithOverrides(fileName string, env []string, flags map[string]string) (SSettings, map[string]int, error) {
 	set := SSettings{}
+	sources := map[string]int{}
 
 	//fill defaults
 	set.MaxConversations = 64000
 	set.MaxInactiveConversationLifeTime = 3600 //second
+	set.ActiveTimeSlice = DefaultActiveTimeSlice
 
 	set.GWMode = false
 	set.NFQueueNumber = 64
 	set.RunIPCommands = true
+	set.TableFullPolicy = "evict"
+	set.EvictIdleTime = DefaultEvictIdleTime
+	set.EvictFallbackPolicy = "fail_open"
+	set.EventQueueSize = 4096
+	set.RuleEvaluationMode = "longest_prefix"
+	set.RulesPollInterval = 60 //second
+	set.RulesHistorySize = DefaultRuleHistorySize
+	set.SizeUnits = "binary"
 
-	if stat, err := os.Stat(fileName); err != nil || stat.Size() > MAX_FILE_SIZE {
-		log.Fatalln(err)
+	//load, the yaml and toml files are converted to json
+	data, err := readConfigFile(fileName)
+	if err != nil {
+		return set, sources, err
 	}
 
-	//load
-	data, err := ioutil.ReadFile(fileName)
+	//all the errors are reported at once
+	file := sConfigFile{SSettings: set}
+	errs, err := decodeConfigStrict(data, &file)
 	if err != nil {
-		log.Fatalln(err)
+		return set, sources, err
 	}
-
-	if err := json.Unmarshal(data, &set); err != nil {
-		log.Fatalln(err)
+	fileValues := map[string]interface{}{}
+	json.Unmarshal(data, &fileValues)
+	for _, name := range getSettingNames() {
+		if _, fnd := fileValues[name]; fnd {
+			sources[name] = SettingSourceFile
+		}
 	}
+	applySettingOverrides(&file.SSettings, env, flags, sources, &errs)
+	validateSettings(&file.SSettings, &errs)
 
-	//for simplicity there is not any settings checking
+	//the groups and the pools could be defined by the included files
+	rules := &file.CJsonRuleRepository
+	if len(file.Include) > 0 {
+		if rules, err = loadRuleFiles(fileName, map[string]bool{}); err != nil {
+			errs.add("include", "%v", err)
+			rules = &file.CJsonRuleRepository
+		}
+	}
+	validateRules(&file.CJsonRuleRepository, rules, &file.SSettings, &errs)
+	if len(errs) > 0 {
+		return file.SSettings, sources, errs
+	}
 
-	return set, nil
+	return file.SSettings, sources, nil
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+//prefix of the environment variables of the settings, for example SIMPLEFW_NFQ_NUMBER overrides nfq_number
+const SettingEnvPrefix = "SIMPLEFW_"
+
+//---------------------------------------------------------------------------------------
+//json names of the settings in the order of SSettings
+func getSettingNames() []string {
+	typ := reflect.TypeOf(SSettings{})
+	names := make([]string, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		names = append(names, strings.Split(typ.Field(i).Tag.Get("json"), ",")[0])
+	}
+	return names
+}
+
+//---------------------------------------------------------------------------------------
+func getSettingEnvName(name string) string {
+	return SettingEnvPrefix + strings.ToUpper(name)
+}
+
+//---------------------------------------------------------------------------------------
+func getSettingFlagName(name string) string {
+	return strings.Replace(name, "_", "-", -1)
+}
+
+//---------------------------------------------------------------------------------------
+//set the field from the text of an override
+func setSettingValue(value reflect.Value, text string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(text)
+	case reflect.Bool:
+		item, err := strconv.ParseBool(strings.TrimSpace(text))
+		if err != nil {
+			return errors.New("should be true or false")
+		}
+		value.SetBool(item)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bits := value.Type().Bits()
+		item, err := strconv.ParseInt(strings.TrimSpace(text), 10, bits)
+		if err != nil {
+			min := int64(-1) << uint(bits-1)
+			return fmt.Errorf("should be an integer between %d and %d", min, -(min + 1))
+		}
+		value.SetInt(item)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		bits := value.Type().Bits()
+		item, err := strconv.ParseUint(strings.TrimSpace(text), 10, bits)
+		if err != nil {
+			return fmt.Errorf("should be an integer between 0 and %d", ^uint64(0)>>uint(64-bits))
+		}
+		value.SetUint(item)
+	case reflect.Slice:
+		//comma separated list, an empty value clears the list
+		items := []string{}
+		for _, item := range strings.Split(text, ",") {
+			if item = strings.TrimSpace(item); len(item) > 0 {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	}
+	return nil
+}
+
+//---------------------------------------------------------------------------------------
+//apply the environment variables and then the flags. the unknown SIMPLEFW_ variables are reported, they are
+//usually typos
+func applySettingOverrides(set *SSettings, env []string, flags map[string]string, sources map[string]int, errs *SConfigErrors) {
+	envValues := map[string]string{}
+	for _, item := range env {
+		if i := strings.Index(item, "="); i > 0 && strings.HasPrefix(item[:i], SettingEnvPrefix) {
+			envValues[item[:i]] = item[i+1:]
+		}
+	}
+
+	value := reflect.ValueOf(set).Elem()
+	for i, name := range getSettingNames() {
+		envName := getSettingEnvName(name)
+		if text, fnd := envValues[envName]; fnd {
+			delete(envValues, envName)
+			if err := setSettingValue(value.Field(i), text); err != nil {
+				errs.add(name, "invalid %s, %v", envName, err)
+			} else {
+				sources[name] = SettingSourceEnv
+			}
+		}
+		if text, fnd := flags[name]; fnd {
+			if err := setSettingValue(value.Field(i), text); err != nil {
+				errs.add(name, "invalid -%s, %v", getSettingFlagName(name), err)
+			} else {
+				sources[name] = SettingSourceFlag
+			}
+		}
+	}
+
+	for envName := range envValues {
+		errs.add(envName, "unknown setting")
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//value of a setting flag. the flags of the bool settings could be used without any value, like -gw-mode
+type sSettingFlag struct {
+	isBool bool
+	value  string
+}
+
+func (thisPt *sSettingFlag) String() string {
+	return thisPt.value
+}
+
+func (thisPt *sSettingFlag) Set(value string) error {
+	thisPt.value = value
+	return nil
+}
+
+func (thisPt *sSettingFlag) IsBoolFlag() bool {
+	return thisPt.isBool
+}
+
+//---------------------------------------------------------------------------------------
+//add a flag for each setting, like -nfq-number for nfq_number. the returned function should be called after the
+//parse, it returns the values of the flags that are set by the json names of the settings. the values are checked
+//when the settings are loaded
+func addSettingFlags(flags *flag.FlagSet) func() map[string]string {
+	typ := reflect.TypeOf(SSettings{})
+	names := map[string]string{}
+	for i, name := range getSettingNames() {
+		flagName := getSettingFlagName(name)
+		names[flagName] = name
+		usage := fmt.Sprintf("override %s of the configuration file, environment variable %s", name, getSettingEnvName(name))
+		flags.Var(&sSettingFlag{isBool: typ.Field(i).Type.Kind() == reflect.Bool}, flagName, usage)
+	}
+
+	return func() map[string]string {
+		values := map[string]string{}
+		flags.Visit(func(item *flag.Flag) {
+			if name, fnd := names[item.Name]; fnd {
+				values[name] = item.Value.String()
+			}
+		})
+		return values
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//print the effective settings with their sources, default, file, env or flag
+func printSettings(writer io.Writer, set SSettings, sources map[string]int) error {
+	table := tabwriter.NewWriter(writer, 0, 0, 2, ' ', 0)
+	value := reflect.ValueOf(set)
+	for i, name := range getSettingNames() {
+		item := fmt.Sprint(value.Field(i).Interface())
+		if value.Field(i).Kind() == reflect.String {
+			item = strconv.Quote(item)
+		} else if items, ok := value.Field(i).Interface().([]string); ok {
+			item = strconv.Quote(strings.Join(items, ","))
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", name, item, GetSettingSourceName(sources[name]))
+	}
+	return table.Flush()
+}
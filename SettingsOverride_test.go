@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+func TestSettingOverrides(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	getSettingFlags := addSettingFlags(flags)
+	if err := flags.Parse([]string{"-nfq-number", "80", "-watch-rules-file"}); err != nil {
+		t.Fatal(err)
+	}
+
+	//flags > env > file > defaults
+	env := []string{"PATH=/bin", "SIMPLEFW_NFQ_NUMBER=70", "SIMPLEFW_GW_MODE=true", "SIMPLEFW_EVENT_LOG_FILE=/tmp/a=b.log", "SIMPLEFW_SUBSCRIBER_NETWORKS=10.0.0.0/8, fd00::/8"}
+	set, sources, err := LoadSettingsWithOverrides("settings/setting.json", env, getSettingFlags())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.NFQueueNumber != 80 || !set.GWMode || !set.WatchRulesFile || set.EventLogFile != "/tmp/a=b.log" || set.MaxConversations != 64000 || set.EventQueueSize != 4096 || !reflect.DeepEqual(set.SubscriberNetworks, []string{"10.0.0.0/8", "fd00::/8"}) {
+		t.Fatalf("invalid settings %+v", set)
+	}
+	for name, source := range map[string]int{
+		"nfq_number":       SettingSourceFlag,
+		"watch_rules_file": SettingSourceFlag,
+		"gw_mode":          SettingSourceEnv,
+		"max_conversation": SettingSourceFile,
+		"event_queue_size": SettingSourceDefault,
+	} {
+		if sources[name] != source {
+			t.Fatalf("invalid source of %s, %s", name, GetSettingSourceName(sources[name]))
+		}
+	}
+
+	output := bytes.Buffer{}
+	if err := printSettings(&output, set, sources); err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`(?m)^nfq_number +80 +flag$`).Match(output.Bytes()) || !regexp.MustCompile(`(?m)^event_log_file +"/tmp/a=b.log" +env$`).Match(output.Bytes()) ||
+		!regexp.MustCompile(`(?m)^subscriber_networks +"10.0.0.0/8,fd00::/8" +env$`).Match(output.Bytes()) {
+		t.Fatalf("invalid output\n%s", output.String())
+	}
+
+	//the invalid values and the unknown variables are reported, the overrides are validated with the file
+	env = []string{"SIMPLEFW_NFQ_NUMBER=70000", "SIMPLEFW_GW_MODE=maybe", "SIMPLEFW_NFQ_NUMBR=1", "SIMPLEFW_RULE_EVALUATION_MODE=first"}
+	_, _, err = LoadSettingsWithOverrides("settings/setting.json", env, map[string]string{"max_conversation": "0"})
+	errs := SConfigErrors{}
+	if !errors.As(err, &errs) {
+		t.Fatalf("invalid error %v", err)
+	}
+	paths := []string{}
+	for _, item := range errs {
+		paths = append(paths, item.Path)
+	}
+	sort.Strings(paths)
+	expected := []string{"SIMPLEFW_NFQ_NUMBR", "gw_mode", "max_conversation", "nfq_number", "rule_evaluation_mode"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("invalid errors\n%v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"time"
+)
+
+//maximum time that a packet could be delayed by the rate limit rules
+const MaxRateLimitDelay = 100 * time.Millisecond
+
+//minimum burst of the rate limits in bytes, one MTU. smaller bursts drop all the full size packets
+const MinRateLimitBurst = 1500
+
+//---------------------------------------------------------------------------------------
+//token bucket of a subscriber. tokens are bytes and the time is in nanoseconds
+type STokenBucket struct {
+	Rate   float64 `json:"rate"`
+	Burst  float64 `json:"burst"`
+	Tokens float64 `json:"tokens"`
+	Last   int64   `json:"last"`
+}
+
+//---------------------------------------------------------------------------------------
+func (thisPt *STokenBucket) refill(now int64) {
+	if thisPt.Last == 0 {
+		thisPt.Tokens = thisPt.Burst
+	} else if now > thisPt.Last {
+		thisPt.Tokens += float64(now-thisPt.Last) * thisPt.Rate / float64(time.Second)
+		if thisPt.Tokens > thisPt.Burst {
+			thisPt.Tokens = thisPt.Burst
+		}
+	}
+	if now > thisPt.Last {
+		thisPt.Last = now
+	}
+}
+
+//---------------------------------------------------------------------------------------
+//take the tokens of a packet. if there are not enough tokens, the packet could be delayed up to maxDelay.
+//returns false if the packet should be dropped, otherwise the delay of the packet
+func (thisPt *STokenBucket) Take(size int, now int64, maxDelay time.Duration) (bool, time.Duration) {
+	thisPt.refill(now)
+
+	if thisPt.Tokens >= float64(size) {
+		thisPt.Tokens -= float64(size)
+		return true, 0
+	}
+
+	//the delayed packets borrow the tokens of the future
+	wait := time.Duration((float64(size) - thisPt.Tokens) / thisPt.Rate * float64(time.Second))
+	if wait <= maxDelay {
+		thisPt.Tokens -= float64(size)
+		return true, wait
+	}
+	return false, 0
+}
+
+//---------------------------------------------------------------------------------------
+func CreateTokenBucket(rate float64, burst float64) *STokenBucket {
+	bucket := new(STokenBucket)
+	bucket.Rate = rate
+	bucket.Burst = burst
+	return bucket
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	//1000 bytes per second and 500 bytes burst
+	bucket := CreateTokenBucket(1000, 500)
+	now := int64(time.Second)
+
+	if ok, _ := bucket.Take(500, now, 0); !ok {
+		t.Fatal("burst should pass")
+	}
+	if ok, _ := bucket.Take(100, now, 0); ok {
+		t.Fatal("empty bucket should drop")
+	}
+
+	//100 bytes after 100ms
+	now += int64(100 * time.Millisecond)
+	if ok, _ := bucket.Take(100, now, 0); !ok {
+		t.Fatal("bucket should be refilled")
+	}
+
+	//delayed packets borrow the future tokens
+	if ok, delay := bucket.Take(50, now, 100*time.Millisecond); !ok || delay != 50*time.Millisecond {
+		t.Fatal("packet should be delayed")
+	}
+	if ok, _ := bucket.Take(100, now, 100*time.Millisecond); ok {
+		t.Fatal("packet should be dropped")
+	}
+
+	//the bucket never holds more than the burst
+	now += int64(10 * time.Second)
+	if ok, _ := bucket.Take(501, now, 0); ok {
+		t.Fatal("burst should be limited")
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"fmt"
+	"math"
 	"net"
+	"strings"
 	"time"
 )
 
 //public utility functions
 
 const DEFAULT_NET = "0.0.0.0/0"
+const DEFAULT_NET6 = "::/0"
 const MAX_FILE_SIZE = 40960000
 const (
 	PROTOCOL_TCP = 6
@@ -35,18 +39,63 @@ func GetProtocolName(protocolNum uint8) string {
 
 // packet data structure and protocols
 type SPacket struct {
-	SIp       net.IP `json:"source"`
-	DIp       net.IP `json:"destination"`
-	Protocol  uint8  `json:"protocol"`
-	IpVersion uint8  `json:"ip_version"`
-	DataSize  uint16 `json:"data_size"`
+	SIp       net.IP           `json:"source"`
+	DIp       net.IP           `json:"destination"`
+	SrcMAC    net.HardwareAddr `json:"source_mac,omitempty"`
+	Protocol  uint8            `json:"protocol"`
+	IpVersion uint8            `json:"ip_version"`
+	DataSize  uint16           `json:"data_size"`
 }
 
 const (
-	PacketProcessResultOK   = 0
-	PacketProcessResultDrop = 1
+	PacketProcessResultOK     = 0
+	PacketProcessResultDrop   = 1
+	PacketProcessResultReject = 2
+	PacketProcessResultMark   = 3
 )
 
+// packet verdict of the rule matcher
+type SVerdict struct {
+	Result   int           `json:"result"`
+	Mark     uint32        `json:"mark"`
+	Delay    time.Duration `json:"delay"`
+	RuleName string        `json:"rule"`
+	Rules    []string      `json:"rules"`
+}
+
+// rule actions when the quota is exceeded
+const (
+	RuleActionDrop     = 0
+	RuleActionReject   = 1
+	RuleActionMark     = 2
+	RuleActionLog      = 3
+	RuleActionThrottle = 4
+)
+
+func GetRuleActionNumber(actionName string) int {
+	if actionName == "reject" {
+		return RuleActionReject
+	} else if actionName == "mark" {
+		return RuleActionMark
+	} else if actionName == "log" {
+		return RuleActionLog
+	} else if actionName == "throttle" {
+		return RuleActionThrottle
+	}
+	return RuleActionDrop
+}
+
+// time source. it could be replaced in the tests
+type IClock interface {
+	Now() time.Time
+}
+
+type CSystemClock struct{}
+
+func (thisPt CSystemClock) Now() time.Time {
+	return time.Now()
+}
+
 // packet providers common interface.
 type IPacketProvider interface {
 	Start() error
@@ -55,21 +104,90 @@ type IPacketProvider interface {
 }
 
 // conversations protocol info and utility functions
+const RateEWMAAlpha = 0.3
+
+//default length of the time slices used by the active time accounting
+const DefaultActiveTimeSlice = 60
+
+//count the time slice of the time stamp as an active one, the slices are sliceLength seconds. activeSlice is the
+//last counted slice
+func updateActiveTime(activeTime *int64, activeSlice *int64, timeStamp int64, sliceLength int64) {
+	if slice := timeStamp / sliceLength; slice > *activeSlice {
+		*activeSlice = slice
+		*activeTime += sliceLength
+	}
+}
+
 type SConversationProtocolStatus struct {
-	Send      uint64 `json:"send"`
-	Receive   uint64 `json:"receive"`
-	StartTime int64  `json:"start_time"`
+	Send           uint64  `json:"send"`
+	Receive        uint64  `json:"receive"`
+	SendPackets    uint64  `json:"send_packets"`
+	ReceivePackets uint64  `json:"receive_packets"`
+	StartTime      int64   `json:"start_time"`
+	LastSeen       int64   `json:"last_seen"`
+	Rate           float64 `json:"rate_bps"`
+	ActiveTime     int64   `json:"active_time"`
+	rateWindow     int64
+	rateBytes      uint64
+	activeSlice    int64
 }
 
 func (thisPt SConversationProtocolStatus) TotalData() uint64 {
 	return thisPt.Send + thisPt.Receive
 }
 
-func (thisPt SConversationProtocolStatus) Duration() int64 {
+func (thisPt SConversationProtocolStatus) TotalPackets() uint64 {
+	return thisPt.SendPackets + thisPt.ReceivePackets
+}
+
+//count the time slice of the time stamp as an active one
+func (thisPt *SConversationProtocolStatus) UpdateActiveTime(timeStamp int64, sliceLength int64) {
+	updateActiveTime(&thisPt.ActiveTime, &thisPt.activeSlice, timeStamp, sliceLength)
+}
+
+//update the EWMA rate. every second of traffic is one sample, idle seconds are zero samples
+func (thisPt *SConversationProtocolStatus) UpdateRate(size uint64, timeStamp int64) {
+	if thisPt.rateWindow == 0 {
+		thisPt.rateWindow = timeStamp
+	}
+	if timeStamp > thisPt.rateWindow {
+		thisPt.Rate = thisPt.CurrentRate(timeStamp)
+		thisPt.rateWindow = timeStamp
+		thisPt.rateBytes = 0
+	}
+	thisPt.rateBytes += size
+}
+
+//return the EWMA rate in bits per second at the given time
+func (thisPt SConversationProtocolStatus) CurrentRate(timeStamp int64) float64 {
+	if thisPt.rateWindow == 0 || timeStamp <= thisPt.rateWindow {
+		return thisPt.Rate
+	}
+	rate := RateEWMAAlpha*float64(thisPt.rateBytes*8) + (1-RateEWMAAlpha)*thisPt.Rate
+	if idle := timeStamp - thisPt.rateWindow - 1; idle > 0 {
+		rate *= math.Pow(1-RateEWMAAlpha, float64(idle))
+	}
+	return rate
+}
+
+func (thisPt SConversationProtocolStatus) Duration(now int64) int64 {
 	if thisPt.StartTime == 0 {
 		return 0
 	}
-	return (time.Now().Unix() - thisPt.StartTime)
+	return (now - thisPt.StartTime)
+}
+
+// rule time accounting modes
+const (
+	RuleTimeModeWall   = 0
+	RuleTimeModeActive = 1
+)
+
+func GetTimeModeNumber(modeName string) int {
+	if modeName == "active" {
+		return RuleTimeModeActive
+	}
+	return RuleTimeModeWall
 }
 
 // conversations status tracker and utility functions
@@ -81,19 +199,32 @@ const (
 type SConversationStatus struct {
 	SrcIP       net.IP                      `json:"src_ip"`
 	DstIP       net.IP                      `json:"dst_ip"`
+	SrcMAC      net.HardwareAddr            `json:"src_mac,omitempty"`
 	TCPStatus   SConversationProtocolStatus `json:"tcp"`
 	UDPStatus   SConversationProtocolStatus `json:"udp"`
 	OtherStatus SConversationProtocolStatus `json:"other"`
+	ActiveTime  int64                       `json:"active_time"`
+	RuleName    string                      `json:"rule"`
+	Exceeded    uint64                      `json:"exceeded"`
+	Drops       uint64                      `json:"drops"`
+	Threshold   int                         `json:"quota_threshold"`
+	activeSlice int64
+	ruleCache   [3]*sRuleCache
+}
+
+//count the time slice of the time stamp as an active one
+func (thisPt *SConversationStatus) UpdateActiveTime(timeStamp int64, sliceLength int64) {
+	updateActiveTime(&thisPt.ActiveTime, &thisPt.activeSlice, timeStamp, sliceLength)
 }
 
-func (thisPt SConversationStatus) Duration() int64 {
+func (thisPt SConversationStatus) Duration(now int64) int64 {
 	MAX := func(A int64, B int64) int64 {
 		if A > B {
 			return A
 		}
 		return B
 	}
-	duration := MAX(MAX(thisPt.TCPStatus.Duration(), thisPt.UDPStatus.Duration()), thisPt.OtherStatus.Duration())
+	duration := MAX(MAX(thisPt.TCPStatus.Duration(now), thisPt.UDPStatus.Duration(now)), thisPt.OtherStatus.Duration(now))
 	return duration
 }
 
@@ -101,6 +232,14 @@ func (thisPt SConversationStatus) TotalData() uint64 {
 	return thisPt.TCPStatus.TotalData() + thisPt.UDPStatus.TotalData() + thisPt.OtherStatus.TotalData()
 }
 
+func (thisPt SConversationStatus) TotalPackets() uint64 {
+	return thisPt.TCPStatus.TotalPackets() + thisPt.UDPStatus.TotalPackets() + thisPt.OtherStatus.TotalPackets()
+}
+
+func (thisPt SConversationStatus) CurrentRate(timeStamp int64) float64 {
+	return thisPt.TCPStatus.CurrentRate(timeStamp) + thisPt.UDPStatus.CurrentRate(timeStamp) + thisPt.OtherStatus.CurrentRate(timeStamp)
+}
+
 func (thisPt SConversationStatus) Direction(packet *SPacket) int {
 	if packet.DIp.Equal(thisPt.DstIP) {
 		return ConversationDirectionSend
@@ -108,27 +247,360 @@ func (thisPt SConversationStatus) Direction(packet *SPacket) int {
 	return ConversationDirectionReceive
 }
 
+// conversation tracker behaviour when the conversation table is full
+const (
+	ConversationTableFullEvict      = 0
+	ConversationTableFullFailClosed = 1
+	ConversationTableFullFailOpen   = 2
+)
+
+func GetTableFullPolicyNumber(policyName string) int {
+	if policyName == "fail_closed" {
+		return ConversationTableFullFailClosed
+	} else if policyName == "fail_open" {
+		return ConversationTableFullFailOpen
+	}
+	return ConversationTableFullEvict
+}
+
+func GetTableFullPolicyName(policy int) string {
+	if policy == ConversationTableFullFailClosed {
+		return "fail_closed"
+	} else if policy == ConversationTableFullFailOpen {
+		return "fail_open"
+	}
+	return "evict"
+}
+
+// rule types. allow and deny rules do not have any quota
+const (
+	RuleTypeQuota = 0
+	RuleTypeAllow = 1
+	RuleTypeDeny  = 2
+)
+
+func GetRuleTypeNumber(typeName string) int {
+	if typeName == "allow" {
+		return RuleTypeAllow
+	} else if typeName == "deny" {
+		return RuleTypeDeny
+	}
+	return RuleTypeQuota
+}
+
+// how the matching rules of a packet are evaluated
+const (
+	RuleEvaluationLongestPrefix = 0
+	RuleEvaluationPriority      = 1
+	RuleEvaluationAll           = 2
+)
+
+func GetRuleEvaluationModeNumber(modeName string) int {
+	if modeName == "priority" {
+		return RuleEvaluationPriority
+	} else if modeName == "all" {
+		return RuleEvaluationAll
+	}
+	return RuleEvaluationLongestPrefix
+}
+
+func GetRuleEvaluationModeName(mode int) string {
+	if mode == RuleEvaluationPriority {
+		return "priority"
+	} else if mode == RuleEvaluationAll {
+		return "all"
+	}
+	return "longest_prefix"
+}
+
+// how the sizes like 1kb are parsed, binary (1kb is 1024 bytes, default) or si (1kb is 1000 bytes)
+const (
+	SizeUnitsBinary = 0
+	SizeUnitsSI     = 1
+)
+
+func GetSizeUnitsNumber(unitsName string) int {
+	if unitsName == "si" {
+		return SizeUnitsSI
+	}
+	return SizeUnitsBinary
+}
+
+func GetSizeUnitsName(units int) string {
+	if units == SizeUnitsSI {
+		return "si"
+	}
+	return "binary"
+}
+
+// formats of the settings and the rules files
+const (
+	ConfigFormatJson = 0
+	ConfigFormatYaml = 1
+	ConfigFormatToml = 2
+)
+
+func GetConfigFormatNumber(formatName string) int {
+	if formatName == "yaml" || formatName == "yml" {
+		return ConfigFormatYaml
+	} else if formatName == "toml" {
+		return ConfigFormatToml
+	}
+	return ConfigFormatJson
+}
+
+func GetConfigFormatName(format int) string {
+	if format == ConfigFormatYaml {
+		return "yaml"
+	} else if format == ConfigFormatToml {
+		return "toml"
+	}
+	return "json"
+}
+
+// sources of the settings, the later sources override the earlier ones
+const (
+	SettingSourceDefault = 0
+	SettingSourceFile    = 1
+	SettingSourceEnv     = 2
+	SettingSourceFlag    = 3
+)
+
+func GetSettingSourceName(source int) string {
+	if source == SettingSourceFile {
+		return "file"
+	} else if source == SettingSourceEnv {
+		return "env"
+	} else if source == SettingSourceFlag {
+		return "flag"
+	}
+	return "default"
+}
+
+// conversation life cycle events
+const (
+	ConversationEventCreated        = 0
+	ConversationEventQuotaThreshold = 1
+	ConversationEventFirstDrop      = 2
+	ConversationEventEvicted        = 3
+)
+
+func GetEventName(eventType int) string {
+	if eventType == ConversationEventCreated {
+		return "created"
+	} else if eventType == ConversationEventQuotaThreshold {
+		return "quota_threshold"
+	} else if eventType == ConversationEventFirstDrop {
+		return "first_drop"
+	}
+	return "evicted"
+}
+
+//quota usage percentages that publish a quota threshold event
+var QuotaEventThresholds = []int{50, 80, 100}
+
+type SConversationEvent struct {
+	Type      int                 `json:"-"`
+	Event     string              `json:"event"`
+	Time      int64               `json:"time"`
+	RuleName  string              `json:"rule"`
+	Threshold int                 `json:"threshold,omitempty"`
+	Reason    string              `json:"reason,omitempty"`
+	Status    SConversationStatus `json:"conversation"`
+}
+
+//timeStamp is the time of the event in seconds
+func NewConversationEvent(eventType int, status *SConversationStatus, timeStamp int64) *SConversationEvent {
+	event := new(SConversationEvent)
+	event.Type = eventType
+	event.Event = GetEventName(eventType)
+	event.Time = timeStamp
+	event.RuleName = status.RuleName
+	event.Status = *status
+	return event
+}
+
+//conversation events observer. it is called from the packet processing path and should not block,
+//CEventDispatcher could be used to decouple slow observers
+type IConversationObserver interface {
+	OnConversationEvent(event *SConversationEvent)
+}
+
+//called under the conversation lock
+type TConversationUpdateFunc func(status *SConversationStatus)
+
+// subscriber status, the rate limit buckets of a subscriber per rule
+type SSubscriberStatus struct {
+	IP      net.IP                   `json:"ip"`
+	Buckets map[string]*STokenBucket `json:"buckets"`
+}
+
+//called under the subscriber lock
+type TSubscriberUpdateFunc func(status *SSubscriberStatus)
+
 //conversation tracker interface
 type IConversationTracker interface {
 	GetStatus(packet *SPacket, timeStamp int64) (bool, SConversationStatus)
+	Update(packet *SPacket, updateFunc TConversationUpdateFunc) bool
+	UpdateSubscriber(ip net.IP, updateFunc TSubscriberUpdateFunc) bool
+	SetObserver(observer IConversationObserver)
+	GetTableFullPolicy() int
+	SetActiveTimeSlice(seconds int64)
+	SetEvictPolicy(idleTime int64, fallbackPolicy int)
 	Dump() string
+	DumpTop(count int) string
+	DumpStat() string
 }
 
 // common rules data structure
 type SRule struct {
-	Name        string `json:"name"`
-	Destination string `json:"destination"`
-	UsageTime   string `json:"usage_time"`
-	UsageSize   string `json:"usage_size"`
-	L4Protocol  string `json:"protocol"`
+	Name        string     `json:"name"`
+	Type        string     `json:"type"`
+	Priority    int        `json:"priority"`
+	Sources     []string   `json:"sources"`
+	Destination string     `json:"destination"`
+	UsageTime   string     `json:"usage_time"`
+	UsageSize   string     `json:"usage_size"`
+	TimeMode    string     `json:"usage_time_mode"`
+	L4Protocol  string     `json:"protocol"`
+	Action      string     `json:"action"`
+	Mark        uint32     `json:"mark"`
+	ThrottleTo  string     `json:"throttle_rate"`
+	RateLimit   string     `json:"rate_limit"`
+	RateAfter   string     `json:"rate_limit_after"`
+	RateBurst   string     `json:"rate_limit_burst"`
+	RateAction  string     `json:"rate_limit_action"`
+	Schedule    *SSchedule `json:"schedule"`
+	Pool        string     `json:"pool"`
+	Origin      string     `json:"-"` // file or repository of the rule, used in the errors
+}
+
+// time window of a rule. a time range like 22:00-07:00 crosses the midnight and belongs to the day it starts
+type SSchedule struct {
+	TimeRanges []string `json:"time_ranges"`
+	Days       []string `json:"days"`
+	TimeZone   string   `json:"timezone"`
+}
+
+// detailed error of the rules. field is the JSON name of the invalid field. rule is empty for the errors
+// that do not belong to a rule, like the pools. origin is the file or the repository of the rule
+type SRuleError struct {
+	Rule   string `json:"rule"`
+	Origin string `json:"origin"`
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+func (thisPt *SRuleError) Error() string {
+	if len(thisPt.Rule) == 0 {
+		return fmt.Sprintf("%s: %s", thisPt.Field, thisPt.Reason)
+	}
+	return fmt.Sprintf("%s, %s: %s", describeRule(thisPt.Rule, thisPt.Origin), thisPt.Field, thisPt.Reason)
+}
+
+// name of the rule with its origin, for example rule x (rules/customer.json)
+func describeRule(name string, origin string) string {
+	if len(origin) == 0 {
+		return fmt.Sprintf("rule %s", name)
+	}
+	return fmt.Sprintf("rule %s (%s)", name, origin)
+}
+
+func newRuleError(rule string, field string, reason string) error {
+	return &SRuleError{Rule: rule, Field: field, Reason: reason}
+}
+
+// error of a configuration field. path is the JSON path of the field, for example rules[3].usage_size
+type SConfigError struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+func (thisPt *SConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", thisPt.Path, thisPt.Reason)
+}
+
+// all the errors of a configuration file
+type SConfigErrors []*SConfigError
+
+func (thisPt SConfigErrors) Error() string {
+	items := make([]string, 0, len(thisPt))
+	for _, item := range thisPt {
+		items = append(items, item.Error())
+	}
+	return fmt.Sprintf("invalid configuration, %d errors\n%s", len(thisPt), strings.Join(items, "\n"))
+}
+
+// a version of the loaded rules. hash is the sha256 of the rules, groups, pools and exempt networks
+type SRuleSetVersion struct {
+	Generation uint64 `json:"generation"`
+	Time       int64  `json:"time"`
+	Hash       string `json:"hash"`
+	RuleCount  int    `json:"rule_count"`
+}
+
+// the kept versions of the rules, from the oldest to the newest. active is the generation of the active version and
+// pinned is the activated version that the reloads do not replace, 0 if the rules of the repository are active
+type SRuleSetHistory struct {
+	Active   uint64            `json:"active"`
+	Pinned   uint64            `json:"pinned"`
+	Versions []SRuleSetVersion `json:"versions"`
+}
+
+// a rule that exists in both versions with different fields
+type SRuleChange struct {
+	Name string `json:"name"`
+	From SRule  `json:"from"`
+	To   SRule  `json:"to"`
+}
+
+// difference of two versions of the rules. other has the names of the other changed fields, like pools
+type SRuleSetDiff struct {
+	From    uint64        `json:"from"`
+	To      uint64        `json:"to"`
+	Added   []SRule       `json:"added"`
+	Removed []SRule       `json:"removed"`
+	Changed []SRuleChange `json:"changed"`
+	Other   []string      `json:"other_changes"`
+}
+
+// named data quota shared by the rules
+type SPool struct {
+	Name string `json:"name"`
+	Size string `json:"size"`
+}
+
+// named group of subscribers. members could be IP addresses, networks or MAC addresses
+type SGroup struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
 }
 
 //rules repository
 type IRuleRepository interface {
+	GetSnapshot() *CJsonRuleRepository
 	GetRules() []SRule
+	GetGroups() []SGroup
+	GetExemptNetworks() []string
+	GetPools() []SPool
+	Reload() error
 }
 
 // rule matchers common interface
 type IRuleMatcher interface {
-	Match(packet *SPacket, timeStamp int64) (int, string)
+	Match(packet *SPacket, timeStamp int64) SVerdict
+	SetObserver(observer IConversationObserver)
+	DumpPools() string
+	TopUpPool(name string, size string) error
+	ResetPool(name string) error
+	Reload() error
+	DumpReloadStatus() string
+	DumpRules() string
+	SetRuleHistory(dir string, size int) error
+	DumpRuleVersions() string
+	DiffRuleVersions(from uint64, to uint64) (string, error)
+	ActivateRuleVersion(generation uint64) error
+	SetSubscriberNetworks(networks []string) error
+	SetSourceMACAvailable(available bool) error
+	Close()
 }
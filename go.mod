@@ -3,9 +3,10 @@ module simplefw
 go 1.16
 
 require (
-	github.com/Telefonica/nfqueue v0.0.0-20181020103925-d4fef8af9783 // indirect
-	github.com/google/gopacket v1.1.19 // indirect
-	github.com/songgao/water v0.0.0-20200317203138-2b4b6d7c09d8 // indirect
-	github.com/vishvananda/netlink v1.1.0 // indirect
-	golang.org/x/sys v0.0.0-20210816183151-1e6c022a8912 // indirect
+	github.com/BurntSushi/toml v1.3.2
+	github.com/florianl/go-nfqueue v1.3.0
+	github.com/fsnotify/fsnotify v1.5.4
+	github.com/google/gopacket v1.1.19
+	go.etcd.io/bbolt v1.3.6
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -11,27 +11,147 @@ import (
 
 func main() {
 
+	//convert the configuration files between json, yaml and toml
+	if len(os.Args) > 1 && os.Args[1] == "convert" {
+		if err := runConvertCommand(os.Args[2:]); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	settingFile := flag.String("f", "", "configuration file")
+	importRules := flag.Bool("import-rules", false, "import the rules of the configuration file to the rules database and exit")
+	printConfig := flag.Bool("print-config", false, "print the effective settings with the source of each value and exit")
+	getSettingFlags := addSettingFlags(flag.CommandLine)
 	flag.Parse()
 
 	if len(*settingFile) < 1 {
 		log.Fatalf("please define valid config file \n")
 	}
 
-	//load setting
-	settings, err := LoadSettings(*settingFile)
+	//load setting, the environment variables and the flags override the file
+	settings, sources, err := LoadSettingsWithOverrides(*settingFile, os.Environ(), getSettingFlags())
+	if *printConfig {
+		if printErr := printSettings(os.Stdout, settings, sources); printErr != nil {
+			log.Fatalln(printErr)
+		}
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	//create rules repository
-	ruleRespos := CreateJsonRuleRepository(*settingFile)
+	var ruleRespos IRuleRepository
+	var ruleDatabase *CBoltRuleRepository
+	var ruleChanges <-chan struct{}
+	if *importRules || len(settings.RulesDatabase) > 0 {
+		if len(settings.RulesDatabase) == 0 {
+			log.Fatalf("rules_database is not defined \n")
+		}
+		ruleDatabase, err = CreateBoltRuleRepository(settings.RulesDatabase)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer ruleDatabase.Close()
+		ruleRespos = ruleDatabase
+		ruleChanges = ruleDatabase.Changes()
+	} else if len(settings.RulesUrl) > 0 {
+		remoteRules, err := CreateHttpRuleRepository(settings.RulesUrl, settings.RulesPublicKey, settings.RulesCacheFile, time.Duration(settings.RulesPollInterval)*time.Second)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer remoteRules.Close()
+		ruleRespos = remoteRules
+		ruleChanges = remoteRules.Changes()
+	} else {
+		ruleRespos, err = CreateJsonRuleRepository(*settingFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	//migrate the json rules to the database
+	if *importRules {
+		jsonRules, err := CreateJsonRuleRepository(*settingFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := ruleDatabase.Import(jsonRules); err != nil {
+			log.Fatalln(err)
+		}
+		log.Printf("%d rules imported to %s \n", len(jsonRules.GetRules()), settings.RulesDatabase)
+		return
+	}
+
+	//the rules of the configuration file override the rules of the database or the server with the same names
+	if len(settings.RulesDatabase) > 0 || len(settings.RulesUrl) > 0 {
+		localRules, err := CreateJsonRuleRepository(*settingFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		ruleRespos = CreateCompositeRuleRepository(ruleRespos, localRules)
+	}
 
 	//create conversation tracker
-	conversation := CreateConversationTracker(int64(settings.MaxInactiveConversationLifeTime), settings.MaxConversations)
+	conversation := CreateConversationTracker(int64(settings.MaxInactiveConversationLifeTime), settings.MaxConversations, GetTableFullPolicyNumber(settings.TableFullPolicy), nil)
+	conversation.SetActiveTimeSlice(int64(settings.ActiveTimeSlice))
+	conversation.SetEvictPolicy(int64(settings.EvictIdleTime), GetTableFullPolicyNumber(settings.EvictFallbackPolicy))
 
 	//create rule matcher
-	ruleMatcher := CreateMatcher(ruleRespos, conversation)
+	ruleMatcher, err := CreateMatcher(ruleRespos, conversation, GetRuleEvaluationModeNumber(settings.RuleEvaluationMode), GetSizeUnitsNumber(settings.SizeUnits), nil, nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer ruleMatcher.Close()
+	if err := ruleMatcher.SetRuleHistory(settings.RulesHistoryDir, int(settings.RulesHistorySize)); err != nil {
+		log.Fatalln(err)
+	}
+	if err := ruleMatcher.SetSubscriberNetworks(settings.SubscriberNetworks); err != nil {
+		log.Fatalln(err)
+	}
+	//the OUTPUT packets of the local mode have no source MAC
+	if err := ruleMatcher.SetSourceMACAvailable(settings.GWMode); err != nil {
+		log.Fatalln(err)
+	}
+
+	//create conversation events dispatcher
+	dispatcher := CreateEventDispatcher(settings.EventQueueSize)
+	if len(settings.EventLogFile) > 0 {
+		sink, err := CreateJsonLinesFileEventSink(settings.EventLogFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		dispatcher.AddObserver(sink)
+		conversation.SetObserver(dispatcher)
+		ruleMatcher.SetObserver(dispatcher)
+	}
+
+	//reload the rules on SIGHUP and optionally when the configuration file or its included files are changed
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			ruleMatcher.Reload()
+		}
+	}()
+	if ruleChanges != nil {
+		go func() {
+			for range ruleChanges {
+				ruleMatcher.Reload()
+			}
+		}()
+	}
+	if settings.WatchRulesFile {
+		watcher, err := CreateRuleFileWatcher(*settingFile, func() { ruleMatcher.Reload() })
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer watcher.Stop()
+	}
 
 	//create packet provider
 	packetProvider := CreateNFQProvider(settings.NFQueueNumber, settings.GWMode, settings.RunIPCommands, ruleMatcher)
@@ -42,7 +162,7 @@ func main() {
 	}
 
 	//start API server
-	CreateApiServer(conversation, packetProvider)
+	CreateApiServer(conversation, packetProvider, dispatcher, ruleMatcher)
 
 	log.Printf("simplefw started successfully \n")
 